@@ -0,0 +1,111 @@
+package dump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Builds the composite aggregation request for the next page of values
+// The after key of the previous page is given back as it is, like search_after
+func aggregate_request(config *Config, ctx *Context) []byte {
+	field, _ := json.Marshal(config.Aggregate)
+	body := fmt.Sprintf(`{"size": 0, "query": %s`, ctx.Query)
+	if ctx.PitId != "" {
+		id, _ := json.Marshal(ctx.PitId)
+		body += fmt.Sprintf(`, "pit": {"id": %s, "keep_alive": "%s"}`, id, pit_keepalive)
+	}
+	after := ""
+	if ctx.after_key != nil {
+		after = `, "after": ` + string(ctx.after_key)
+	}
+	body += fmt.Sprintf(`, "aggs": {"values": {"composite": {"size": %d, "sources": [{"value": {"terms": {"field": %s}}}]%s}}}}`, ctx.Size, field, after)
+	return []byte(body)
+}
+
+// Queries one page of values, and turns the buckets into output documents
+func aggregate_page(parser *fastjson.Parser, config *Config, ctx *Context) (result [][]byte, done bool, err error) {
+	uri, _, err := search_request(config, ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	started := time.Now()
+	body, err := http_request(config.Method, uri, aggregate_request(config, ctx), config, ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	latency := time.Since(started)
+	record_latency(config, ctx, latency)
+	adapt_size(config, ctx, latency)
+	parsed, err := parser.ParseBytes(body)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := check_shards(parsed.Get("_shards"), config); err != nil {
+		return nil, false, err
+	}
+	if id := parsed.GetStringBytes("pit_id"); id != nil {
+		ctx.PitId = string(id)
+	}
+	agg := parsed.Get("aggregations", "values")
+	if agg == nil {
+		return nil, false, errors.New("JSON result looks incorrect, there is no composite aggregation")
+	}
+	for _, bucket := range agg.GetArray("buckets") {
+		// The maximum is of values, not of the documents they come from
+		if config.MaxDocs > 0 && int(ctx.Counter.Load()) >= config.MaxDocs {
+			config.debugf("Reached the maximum of %d values", config.MaxDocs)
+			return result, true, nil
+		}
+		ctx.scratch = append(ctx.scratch[:0], `{"value":`...)
+		ctx.scratch = bucket.Get("key", "value").MarshalTo(ctx.scratch)
+		ctx.scratch = append(ctx.scratch, `,"doc_count":`...)
+		ctx.scratch = bucket.Get("doc_count").MarshalTo(ctx.scratch)
+		ctx.scratch = append(ctx.scratch, '}')
+		ctx.Counter.Add(1)
+		result = append(result, copy_to_arena(ctx.scratch, ctx))
+	}
+	// The last page may still have an after key, the next one is then empty
+	after := agg.Get("after_key")
+	if after == nil || len(result) == 0 {
+		config.debugf("No more values, bailing out")
+		return result, true, nil
+	}
+	ctx.after_key = after.MarshalTo(ctx.after_key[:0])
+	return result, false, nil
+}
+
+// Loops the pages of the composite aggregation, sending the values to the channel
+func aggregate_producer(ctx *Context, config *Config) error {
+	parser := &fastjson.Parser{}
+	for {
+		if err := wait_for_consumers(config, ctx); err != nil {
+			return err
+		}
+		r, done, err := aggregate_page(parser, config, ctx)
+		if err != nil {
+			return err
+		}
+		config.Metrics.add_window()
+		ctx.http_dump.close(config)
+		if len(r) > 0 {
+			if err := throttle(ctx, len(r)); err != nil {
+				return err
+			}
+		}
+		for x := 0; x < len(r); x += config.Batch {
+			if err := send(r[x:min(x+config.Batch, len(r))], config, ctx); err != nil {
+				return err
+			}
+		}
+		ctx.window_sent(config)
+		if done {
+			break
+		}
+	}
+	config.debugf("Producer done")
+	return nil
+}
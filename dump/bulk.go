@@ -0,0 +1,39 @@
+package dump
+
+import (
+	"errors"
+
+	"github.com/valyala/fastjson"
+)
+
+// Turns a search hit into the action and source lines of the _bulk API
+func bulk_entry(parser *fastjson.Parser, data []byte) ([]byte, error) {
+	hit, err := parser.ParseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	source := hit.Get("_source")
+	if source == nil {
+		return nil, errors.New("hit has no _source for a bulk action, dumping it needs _source enabled")
+	}
+	// The values are marshaled as they are, so the strings stay escaped correctly
+	entry := append([]byte(nil), `{"index":{"_index":`...)
+	entry = hit.Get("_index").MarshalTo(entry)
+	if id := hit.Get("_id"); id != nil {
+		entry = append(entry, `,"_id":`...)
+		entry = id.MarshalTo(entry)
+	}
+	// Documents routed on a custom value are found only with the same routing
+	if routing := hit.Get("_routing"); routing != nil {
+		entry = append(entry, `,"routing":`...)
+		entry = routing.MarshalTo(entry)
+	}
+	// Dumped with their versions, a restore does not overwrite newer documents
+	if version := hit.Get("_version"); version != nil {
+		entry = append(entry, `,"version":`...)
+		entry = version.MarshalTo(entry)
+		entry = append(entry, `,"version_type":"external"`...)
+	}
+	entry = append(entry, "}}\n"...)
+	return source.MarshalTo(entry), nil
+}
@@ -0,0 +1,116 @@
+package dump
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Compressions implied by output file extensions
+var extension_compressions = map[string]string{
+	".br":  "brotli",
+	".gz":  "gzip",
+	".zst": "zstd",
+}
+
+// Returns the name of the compression used for output
+func compression(config *Config) string {
+	switch {
+	case config.Brotli:
+		return "brotli"
+	case config.Gzip:
+		return "gzip"
+	case config.Zstd:
+		return "zstd"
+	}
+	return "none"
+}
+
+// Picks the compression from the file extension, if none was chosen explicitly
+func infer_compression(config *Config) error {
+	// Parallel gzip writes the same format
+	if config.Pgzip {
+		config.Gzip = true
+	}
+	explicit := 0
+	for _, on := range []bool{config.Brotli, config.Gzip, config.Zstd} {
+		if on {
+			explicit++
+		}
+	}
+	if explicit > 1 {
+		return fmt.Errorf("only one compression can be used, got %s", compression(config))
+	}
+	implied := ""
+	for ext, name := range extension_compressions {
+		if strings.HasSuffix(config.File, ext) {
+			implied = name
+		}
+	}
+	if implied == "" {
+		return nil
+	}
+	if explicit == 0 {
+		config.Brotli = implied == "brotli"
+		config.Gzip = implied == "gzip"
+		config.Zstd = implied == "zstd"
+		config.debugf("Compressing with %s, based on the file name %s", implied, config.File)
+		return nil
+	}
+	if compression(config) != implied {
+		return fmt.Errorf("file name %s implies %s compression, but %s was requested", config.File, implied, compression(config))
+	}
+	return nil
+}
+
+// Builds the compressor writing into w at the quality, nil if not compressing
+func new_compressor(w io.Writer, config *Config, quality int) (io.WriteCloser, error) {
+	switch {
+	case config.Brotli:
+		opts := brotli.WriterOptions{}
+		opts.Quality = quality
+		opts.LGWin = config.BrotliLgwin
+		return brotli.NewWriterOptions(w, opts), nil
+	case config.Pgzip:
+		return pgzip.NewWriterLevel(w, quality)
+	case config.Gzip:
+		return gzip.NewWriterLevel(w, quality)
+	case config.Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(quality)))
+	}
+	return nil, nil
+}
+
+// Qualities the automatic tuning moves between, from the fastest
+func quality_range(config *Config) (int, int) {
+	switch {
+	case config.Brotli:
+		return 0, 11
+	case config.Gzip, config.Zstd:
+		return 1, 9
+	}
+	return 0, 0
+}
+
+// Nudges the quality by how full the channel is, when a file or gzip member starts
+// A channel filling up means that the writers are the bottleneck, an empty one leaves them CPU to spare
+func (ctx *Context) tune_quality(config *Config) int {
+	low, high := quality_range(config)
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	fill := 100 * len(*ctx.Tasks) / max(cap(*ctx.Tasks), 1)
+	switch {
+	case fill >= 50 && ctx.quality > low:
+		ctx.quality--
+		config.debugf("Channel is %d%% full, lowering compression quality to %d", fill, ctx.quality)
+	case fill <= 10 && ctx.quality < high:
+		ctx.quality++
+		config.debugf("Channel is %d%% full, raising compression quality to %d", fill, ctx.quality)
+	}
+	return ctx.quality
+}
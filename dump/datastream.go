@@ -0,0 +1,25 @@
+package dump
+
+import (
+	"fmt"
+)
+
+// Checks whether the index is a data stream, and lists its backing indices
+func query_data_stream(config *Config, ctx *Context) ([]string, error) {
+	uri := fmt.Sprintf("%s/_data_stream/%s", config.Base, escape_index(config.Index))
+	body, err := http_get(uri, nil, config, ctx)
+	if err != nil {
+		return nil, err
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	var indices []string
+	for _, ds := range json.GetArray("data_streams") {
+		for _, i := range ds.GetArray("indices") {
+			indices = append(indices, string(i.GetStringBytes("index_name")))
+		}
+	}
+	return indices, nil
+}
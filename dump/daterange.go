@@ -0,0 +1,27 @@
+package dump
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Limits the query to the documents between From and To of the time field, in UTC
+// The times are resolved before the dump, so that every window and the count see the same range
+func date_range_filter(config *Config) string {
+	field, _ := json.Marshal(config.TimeField)
+	bounds := []string{}
+	if !config.From.IsZero() {
+		bounds = append(bounds, fmt.Sprintf(`"gte": "%s"`, config.From.UTC().Format(watermark_layout)))
+	}
+	if !config.To.IsZero() {
+		bounds = append(bounds, fmt.Sprintf(`"lt": "%s"`, config.To.UTC().Format(watermark_layout)))
+	}
+	bounds = append(bounds, `"format": "strict_date_optional_time"`)
+	return fmt.Sprintf(`{"range": {%s: {%s}}}`, field, strings.Join(bounds, ", "))
+}
+
+// Tells whether the dump is limited to a date range
+func date_ranged(config *Config) bool {
+	return !config.From.IsZero() || !config.To.IsZero()
+}
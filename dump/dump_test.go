@@ -0,0 +1,42 @@
+package dump
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIncrementalLeavesNothingOut(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		err    string
+	}{
+		{"plain", func(c *Config) {}, ""},
+		{"deduplicated", func(c *Config) { c.Dedup = true }, ""},
+		{"tolerant search_after", func(c *Config) { c.Tolerant = true }, ""},
+		{"max docs", func(c *Config) { c.MaxDocs = 10 }, "cannot skip or limit"},
+		{"skip", func(c *Config) { c.Skip = 10 }, "cannot skip or limit"},
+		{"sample every", func(c *Config) { c.SampleEvery = 2 }, "cannot be sampled"},
+		{"sample rate", func(c *Config) { c.SampleRate = 0.5 }, "cannot be sampled"},
+		{"tolerant scroll", func(c *Config) { c.Tolerant = true; c.Mode = "scroll" }, "scroll mode"},
+		{"aggregate", func(c *Config) { c.Aggregate = "host" }, "cannot be aggregated"},
+		{"append", func(c *Config) { c.Append = true }, ""},
+		{"append split", func(c *Config) { c.Append = true; c.MaxFileSize = 1 << 30 }, "append only to a single file"},
+		{"append bulk", func(c *Config) { c.Append = true; c.Format = "bulk"; c.BulkActions = 1000 }, "append only to a single file"},
+		{"append partitioned", func(c *Config) { c.Append = true; c.PartitionBy = "source" }, "append only to a single file"},
+		{"split without append", func(c *Config) { c.MaxFileSize = 1 << 30 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Index: "graylog_0", File: "graylog_0.json", Base: "http://localhost:9200", Size: 100, Incremental: "@timestamp"}
+			tt.change(config)
+			_, err := new_dumper(config, nil, nil, nil)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
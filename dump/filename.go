@@ -0,0 +1,56 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Values available in the output file name, e.g. graylog_0-{{.Date}}.json
+type file_vars struct {
+	Index string
+	// Start time of the run, for custom layouts like {{.Start.Format "20060102T1504"}}
+	Start time.Time
+	// Start date as 2006-01-02
+	Date string
+	// Start time of day as 150405
+	Time string
+}
+
+// Parses the output file name template, and checks that it can be expanded
+func build_file_template(config *Config) (*template.Template, error) {
+	tmpl, err := template.New("file").Option("missingkey=error").Parse(config.File)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file name template %q: %w", config.File, err)
+	}
+	// Unknown fields are noticed only when executing, so try it before starting
+	if _, err := expand_file_name(tmpl, config, time.Now()); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Expands the output file name template for a run started at start
+func expand_file_name(tmpl *template.Template, config *Config, start time.Time) (string, error) {
+	vars := file_vars{
+		Index: config.Index,
+		Start: start,
+		Date:  start.Format("2006-01-02"),
+		Time:  start.Format("150405"),
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, vars); err != nil {
+		return "", fmt.Errorf("invalid file name template %q: %w", config.File, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("file name template %q expands to an empty name", config.File)
+	}
+	return buf.String(), nil
+}
+
+// Expands {{.Index}} in the name of a sidecar file, so that every index of a multi-index run has its own
+func index_name(name string, index string) string {
+	return strings.ReplaceAll(name, "{{.Index}}", index)
+}
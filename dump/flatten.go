@@ -0,0 +1,85 @@
+package dump
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// Replaces the nested objects of _source with dot-path keys, so that tabular tools get a column per field
+// Empty objects and arrays are kept under their path, as nothing could stand for them, and nulls stay null
+func flatten(hit *fastjson.Value, config *Config, ctx *Context) {
+	source := hit.Get("_source")
+	if source == nil || source.Type() != fastjson.TypeObject {
+		return
+	}
+	ctx.flat_arena.Reset()
+	flat := ctx.flat_arena.NewObject()
+	flatten_into(flat, "", source, config, ctx)
+	hit.Set("_source", flat)
+}
+
+// Sets the leaves of the value into flat, under the prefix
+func flatten_into(flat *fastjson.Value, prefix string, v *fastjson.Value, config *Config, ctx *Context) {
+	switch v.Type() {
+	case fastjson.TypeObject:
+		o, _ := v.Object()
+		if o.Len() == 0 && prefix != "" {
+			flat.Set(prefix, v)
+			return
+		}
+		o.Visit(func(key []byte, child *fastjson.Value) {
+			flatten_into(flat, join_path(prefix, string(key)), child, config, ctx)
+		})
+	case fastjson.TypeArray:
+		values, _ := v.Array()
+		if len(values) == 0 {
+			flat.Set(prefix, v)
+			return
+		}
+		// Arrays of objects or arrays would lose their structure when joined, so they are always indexed
+		if config.FlattenArrays == "join" && scalars(values) {
+			parts := make([]string, len(values))
+			for i, e := range values {
+				parts[i] = scalar_text(e)
+			}
+			flat.Set(prefix, ctx.flat_arena.NewString(strings.Join(parts, ",")))
+			return
+		}
+		for i, e := range values {
+			flatten_into(flat, join_path(prefix, strconv.Itoa(i)), e, config, ctx)
+		}
+	default:
+		flat.Set(prefix, v)
+	}
+}
+
+// Joins the key to the dot-path of its parent
+func join_path(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// Tells whether none of the values is an object or an array
+func scalars(values []*fastjson.Value) bool {
+	for _, v := range values {
+		if t := v.Type(); t == fastjson.TypeObject || t == fastjson.TypeArray {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a scalar as text for joining, strings without quotes and nulls as nothing
+func scalar_text(v *fastjson.Value) string {
+	switch v.Type() {
+	case fastjson.TypeString:
+		return string(v.GetStringBytes())
+	case fastjson.TypeNull:
+		return ""
+	}
+	return string(v.MarshalTo(nil))
+}
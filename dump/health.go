@@ -0,0 +1,28 @@
+package dump
+
+import (
+	"fmt"
+)
+
+// Health statuses, from the worst
+var health_statuses = map[string]int{"red": 0, "yellow": 1, "green": 2}
+
+// Checks that the health of the index is at least the configured status
+func check_health(config *Config, ctx *Context) error {
+	uri := fmt.Sprintf("%s/_cluster/health/%s", config.Base, escape_index(config.Index))
+	body, err := http_get(uri, nil, config, ctx)
+	if err != nil {
+		return err
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return err
+	}
+	status := string(json.GetStringBytes("status"))
+	unassigned := json.GetInt("unassigned_shards")
+	config.debugf("Health of %s is %s with %d unassigned shards", config.Index, status, unassigned)
+	if level, ok := health_statuses[status]; !ok || level < health_statuses[config.HealthCheck] {
+		return fmt.Errorf("health of %s is %s, required %s, %d unassigned shards", config.Index, status, config.HealthCheck, unassigned)
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+	"golang.org/x/net/proxy"
+)
+
+// Builds HTTP or HTTPS client depending on configuration
+func build_http_client(conf *Config) (*http.Client, error) {
+	proxy, err := build_proxy(conf)
+	if err != nil {
+		return nil, err
+	}
+	// If configured, build TLS client
+	if conf.Tls {
+		return build_tls_http_client(conf, proxy)
+	}
+	// Else build non-TLS client
+	transport, err := build_transport(conf, proxy)
+	if err != nil {
+		return nil, err
+	}
+	conf.debugf("Built http client")
+	return &http.Client{Transport: transport}, nil
+}
+
+// Builds the transport shared by both clients, with the configured connection pool
+func build_transport(conf *Config, proxy func(*http.Request) (*url.URL, error)) (*http.Transport, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: conf.KeepAlive}
+	dial, err := build_socks5(conf, dialer)
+	if err != nil {
+		return nil, err
+	}
+	// A custom TLS config would otherwise disable HTTP/2, which multiplexes the parallel searches over one connection
+	transport := &http.Transport{Proxy: proxy, DialContext: dial, MaxConnsPerHost: conf.MaxConnsPerHost, ForceAttemptHTTP2: !conf.Http1}
+	transport.IdleConnTimeout = 90 * time.Second
+	if conf.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = conf.IdleConnTimeout
+	}
+	if conf.Http1 {
+		// An empty map, instead of nil, keeps net/http from upgrading to HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	// All connections go to the same cluster, so the idle limit applies per host too
+	if conf.MaxIdleConns > 0 {
+		transport.MaxIdleConns = conf.MaxIdleConns
+		transport.MaxIdleConnsPerHost = conf.MaxIdleConns
+	}
+	return transport, nil
+}
+
+// Returns the dial function, tunneling every connection through the SOCKS5 proxy if one is configured
+// TLS and any HTTP proxy are on top of the tunnel, like on a direct connection
+func build_socks5(conf *Config, dialer *net.Dialer) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if conf.Socks5 == "" {
+		return dialer.DialContext, nil
+	}
+	s := conf.Socks5
+	if !strings.Contains(s, "://") {
+		s = "socks5://" + s
+	}
+	u, err := url.Parse(s)
+	if err == nil && u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		err = fmt.Errorf("unsupported scheme %s, expected socks5 or socks5h", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy %q: %w", conf.Socks5, err)
+	}
+	d, err := proxy.FromURL(u, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy %q: %w", conf.Socks5, err)
+	}
+	conf.debugf("Using SOCKS5 proxy %s", u.Redacted())
+	return d.(proxy.ContextDialer).DialContext, nil
+}
+
+// Returns the proxy function, explicit proxy overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func build_proxy(conf *Config) (func(*http.Request) (*url.URL, error), error) {
+	if conf.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(conf.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", conf.Proxy, err)
+	}
+	conf.debugf("Using proxy %s", u.Redacted())
+	return http.ProxyURL(u), nil
+}
+
+// Supported minimum TLS versions
+var tls_versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Lists the CA certificate files, from a comma separated list of files and directories of .pem files
+func ca_files(ca string) ([]string, error) {
+	var files []string
+	for _, name := range strings.Split(ca, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		// ReadDir sorts by name, so the order does not depend on the file system
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".pem") {
+				files = append(files, filepath.Join(name, e.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no .pem files in CA directory %s", name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no CA certificate given")
+	}
+	return files, nil
+}
+
+// Adds the certificates of the PEM file to the pool, returning how many there were
+// Unlike AppendCertsFromPEM, tells what the file had instead when there were none
+func load_ca_file(pool *x509.CertPool, file string, conf *Config) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var other []string
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			other = append(other, block.Type)
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			conf.warnf("Skipping invalid certificate %d in CA file %s: %s", n+len(other)+1, file, err)
+			other = append(other, "invalid CERTIFICATE")
+			continue
+		}
+		pool.AddCert(cert)
+		n++
+	}
+	if n > 0 {
+		return n, nil
+	}
+	if len(other) == 0 {
+		return 0, fmt.Errorf("no valid certificates found in CA file %s, expected PEM CERTIFICATE blocks but found no PEM data", file)
+	}
+	return 0, fmt.Errorf("no valid certificates found in CA file %s, expected PEM CERTIFICATE blocks but found %s", file, strings.Join(other, ", "))
+}
+
+// Builds HTTPS client, if requested
+func build_tls_http_client(conf *Config, proxy func(*http.Request) (*url.URL, error)) (*http.Client, error) {
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool(), MinVersion: tls_versions[conf.TlsMinVersion], ServerName: conf.TlsServerName}
+	// New connections resume earlier sessions, instead of a full handshake every time
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	transport, err := build_transport(conf, proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: transport}
+	files, err := ca_files(conf.Tls_ca)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		n, err := load_ca_file(tlsConfig.RootCAs, file, conf)
+		if err != nil {
+			return nil, err
+		}
+		conf.debugf("Trusting %d CA certificates from %s", n, file)
+	}
+	conf.debugf("Built https client")
+	return client, nil
+}
+
+// Media type Elasticsearch 8 expects from clients written for older versions
+const es_compat_media_type = "application/vnd.elasticsearch+json; compatible-with=8"
+
+// Maximum length of response body included in error messages
+const error_body_limit = 1024
+
+// Shortens the body for error messages
+func truncate(body []byte, limit int) string {
+	if len(body) > limit {
+		return fmt.Sprintf("%s... (%d bytes truncated)", body[:limit], len(body)-limit)
+	}
+	return string(body)
+}
+
+// Describes an error response, using the error object of opensearch if there is one
+func describe_body(body []byte) string {
+	json, err := fastjson.ParseBytes(body)
+	if err == nil && json.Exists("error") {
+		return error_reason(json)
+	}
+	return truncate(body, error_body_limit)
+}
+
+// Returns error.type of an error response, empty if there is none
+func error_type(body []byte) string {
+	json, err := fastjson.ParseBytes(body)
+	if err != nil {
+		return ""
+	}
+	return string(json.GetStringBytes("error", "type"))
+}
+
+// Error response from the cluster
+type HTTPError struct {
+	StatusCode int
+	URI        string
+	// Type of the error in the response body, such as index_not_found_exception, empty if not given
+	Type string
+	// Reason given in the response body
+	Reason string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("got invalid HTTP status code %d from %s: %s", e.StatusCode, e.URI, e.Reason)
+}
+
+// Escapes an index name, list or pattern for the path of a URL
+// Colons of cross-cluster names stay as they are, plus signs would otherwise be decoded as spaces
+func escape_index(index string) string {
+	return strings.ReplaceAll(url.PathEscape(index), "+", "%2B")
+}
+
+// Helper function for opensearch queries
+func http_get(uri string, body []byte, config *Config, ctx *Context) ([]byte, error) {
+	return http_request("GET", uri, body, config, ctx)
+}
+
+// Helper function for opensearch requests with any method
+func http_request(method string, uri string, body []byte, config *Config, ctx *Context) ([]byte, error) {
+	rc, err := http_stream(method, uri, body, config, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	// One byte over the limit tells that the response did not fit
+	if config.MaxResponseBytes > 0 {
+		r = io.LimitReader(rc, config.MaxResponseBytes+1)
+	}
+	bodyBytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxResponseBytes > 0 && int64(len(bodyBytes)) > config.MaxResponseBytes {
+		return nil, fmt.Errorf("response from %s is larger than the maximum of %d bytes, lower the window size", uri, config.MaxResponseBytes)
+	}
+	config.debugf("Response body: %s", bodyBytes)
+	return bodyBytes, nil
+}
+
+// Path of this module, for finding its version in the build info
+const module_path = "github.com/mikkolehtisalo/osdump"
+
+// Backoff of retries without Retry-After, doubled after every attempt
+const (
+	retry_wait     = time.Second
+	max_retry_wait = 30 * time.Second
+)
+
+// Helper function for opensearch requests, returning the response body unread
+// Network errors and overloaded clusters are retried
+func http_stream(method string, uri string, body []byte, config *Config, ctx *Context) (io.ReadCloser, error) {
+	wait := retry_wait
+	for attempt := 0; ; attempt++ {
+		if err := ctx.backoff.wait(ctx.Ctx); err != nil {
+			return nil, err
+		}
+		rc, retry_after, err := http_attempt(method, uri, body, config, ctx)
+		if err == nil || retry_after < 0 || attempt >= config.Retries || ctx.Ctx.Err() != nil {
+			return rc, err
+		}
+		// A write may have been applied before the failure, and repeating it could apply it twice
+		if !read_only(method, uri) && !declined(err) {
+			return rc, err
+		}
+		if retry_after == 0 {
+			retry_after = wait
+			wait = min(wait*2, max_retry_wait)
+		}
+		config.warnf("Retrying in %s, attempt %d of %d: %s", retry_after, attempt+1, config.Retries, err)
+		config.Metrics.add_retry()
+		ctx.Retries.Add(1)
+		// Throttling of one request holds back the others as well, so that they do not pile on the cluster
+		if throttled(err) {
+			ctx.backoff.hold(retry_after)
+		}
+		select {
+		case <-time.After(retry_after):
+		case <-ctx.Ctx.Done():
+			return nil, ctx.Ctx.Err()
+		}
+	}
+}
+
+// Endpoints that only read even when POSTed to, scrolls and points in time are under _search
+// A refresh changes nothing but what is searchable, so it is as safe to repeat
+// Index names cannot start with an underscore, so they are not mistaken for these
+var read_endpoints = map[string]bool{"_search": true, "_count": true, "_pit": true, "_refresh": true}
+
+// Tells whether repeating the request cannot change anything in the cluster
+// Opening and closing points in time and scrolls only hold or release resources
+func read_only(method string, uri string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if read_endpoints[segment] {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells whether the request surely was not applied, because it was never sent or the cluster refused it at once
+func declined(err error) bool {
+	var oerr *net.OpError
+	if errors.As(err, &oerr) && oerr.Op == "dial" {
+		return true
+	}
+	var herr *HTTPError
+	return errors.As(err, &herr) && herr.StatusCode == http.StatusTooManyRequests
+}
+
+// Tells whether the cluster asked to slow down, rather than the request failing
+func throttled(err error) bool {
+	var herr *HTTPError
+	return errors.As(err, &herr) && (herr.StatusCode == http.StatusTooManyRequests || herr.StatusCode == http.StatusServiceUnavailable)
+}
+
+// Pause shared by all requests to the cluster, so that they back off and recover together
+type backoff struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// Holds back the requests for the duration, unless they already are for longer
+func (b *backoff) hold(d time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+}
+
+// Waits until the requests may continue
+func (b *backoff) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	d := time.Until(b.until)
+	b.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Identifies the requests in the access logs of the cluster, with the version of the module when it is known
+func default_user_agent() string {
+	version := "devel"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		// As a library the module is a dependency of the main module
+		for _, m := range append([]*debug.Module{&info.Main}, info.Deps...) {
+			if m.Path == module_path && m.Version != "" && m.Version != "(devel)" {
+				version = m.Version
+			}
+		}
+	}
+	return "osdump/" + version
+}
+
+// Parses Retry-After, either seconds or a date, 0 if missing or invalid
+func parse_retry_after(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// Makes a single request, retry_after tells whether it can be retried
+// It is negative for errors that would not go away, 0 for retrying with backoff, and otherwise what the cluster asked for
+func http_attempt(method string, uri string, body []byte, config *Config, ctx *Context) (io.ReadCloser, time.Duration, error) {
+	config.debugf("URI for HTTP %s: %s", method, uri)
+	br := bytes.NewReader(body)
+	req, err := http.NewRequestWithContext(ctx.Ctx, method, uri, br)
+	if err != nil {
+		return nil, -1, err
+	}
+	content_type := config.ContentType
+	if config.EsCompat {
+		req.Header.Add("Accept", es_compat_media_type)
+		if content_type == "" {
+			content_type = es_compat_media_type
+		}
+	}
+	if content_type == "" {
+		content_type = "application/json"
+	}
+	req.Header.Add("Content-Type", content_type)
+	req.Header.Set("User-Agent", config.UserAgent)
+	req.SetBasicAuth(config.User, config.Password)
+	// Custom headers are added last, repeated keys accumulate
+	for key, values := range config.Headers {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	ctx.http_dump.request(req)
+	resp, err := ctx.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx.http_dump.response(resp)
+	config.debugf("Response code: %d", resp.StatusCode)
+	// Anything besides 200 OK is probably fatal, the body usually tells why
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		// Bounded like any other response, a cut off body only describes the error less well
+		var r io.Reader = resp.Body
+		if config.MaxResponseBytes > 0 {
+			r = io.LimitReader(resp.Body, config.MaxResponseBytes)
+		}
+		bodyBytes, err := io.ReadAll(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		config.debugf("Response body: %s", bodyBytes)
+		err = &HTTPError{StatusCode: resp.StatusCode, URI: uri, Type: error_type(bodyBytes), Reason: describe_body(bodyBytes)}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return nil, parse_retry_after(resp.Header.Get("Retry-After")), err
+		}
+		return nil, -1, err
+	}
+	return resp.Body, 0, nil
+}
@@ -0,0 +1,99 @@
+package dump
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Credentials in the dumped requests, which are attached to bug reports
+var authorization_header = regexp.MustCompile(`(?mi)^(Authorization|Proxy-Authorization):.*$`)
+
+// Raw requests and responses up to the first search window, for reproducing what the dump did
+type http_dump struct {
+	mu   sync.Mutex
+	name string
+	file *os.File
+	err  error
+}
+
+// Creates the dump file, refusing to overwrite an existing one like the output
+func open_http_dump(name string, config *Config) (*http_dump, error) {
+	if err := make_parent(name, config); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, config.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(config.FileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &http_dump{name: name, file: f}, nil
+}
+
+// Writes the request with its body, before it is sent
+func (h *http_dump) request(req *http.Request) {
+	if !h.active() {
+		return
+	}
+	b, err := httputil.DumpRequestOut(req, true)
+	h.write(authorization_header.ReplaceAll(b, []byte("$1: [redacted]")), err)
+}
+
+// Writes the response with its body, which is read into memory and replaced
+func (h *http_dump) response(resp *http.Response) {
+	if !h.active() {
+		return
+	}
+	b, err := httputil.DumpResponse(resp, true)
+	h.write(b, err)
+}
+
+// Tells whether the requests are still dumped, so that nothing is copied after the first window
+func (h *http_dump) active() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file != nil && h.err == nil
+}
+
+// Appends a dumped message, the first failure stops dumping
+func (h *http_dump) write(b []byte, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil || h.err != nil {
+		return
+	}
+	if err == nil {
+		_, err = h.file.Write(append(b, "\n\n"...))
+	}
+	h.err = err
+}
+
+// Stops dumping, after the first window or at the end of the dump
+func (h *http_dump) close(config *Config) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return
+	}
+	if err := h.file.Close(); h.err == nil {
+		h.err = err
+	}
+	h.file = nil
+	// Only a debugging aid, the dump itself is fine without it
+	if h.err != nil {
+		config.warnf("Writing the HTTP dump %s failed: %s", h.name, h.err)
+		return
+	}
+	config.logf("Wrote the HTTP requests and responses to %s", h.name)
+}
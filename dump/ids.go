@@ -0,0 +1,73 @@
+package dump
+
+import (
+	"encoding/json"
+)
+
+// Ids asked for in a single query, long lists are dumped a chunk at a time
+const ids_chunk_size = 10000
+
+// Limits the query to the documents with the given ids
+func ids_filter(ids []string) string {
+	values, _ := json.Marshal(ids)
+	return `{"ids": {"values": ` + string(values) + `}}`
+}
+
+// Returns the ids of the chunk, nil without ids
+func ids_chunk(config *Config, chunk int) []string {
+	if len(config.Ids) == 0 {
+		return nil
+	}
+	return config.Ids[chunk*ids_chunk_size : min((chunk+1)*ids_chunk_size, len(config.Ids))]
+}
+
+// Builds the query of the current chunk of ids, with the filters of the dump
+func current_query(config *Config, ctx *Context) string {
+	filters := ctx.filters
+	if ids := ids_chunk(config, ctx.ids_chunk); ids != nil {
+		filters = append(filters[:len(filters):len(filters)], ids_filter(ids))
+	}
+	return build_query(config, filters...)
+}
+
+// Moves on to the next chunk of ids, false once there are none left
+// The search starts over, as the documents of the chunks are not in the sort order
+func next_ids_chunk(config *Config, ctx *Context) bool {
+	if (ctx.ids_chunk+1)*ids_chunk_size >= len(config.Ids) {
+		return false
+	}
+	if config.MaxDocs > 0 && int(ctx.Counter.Load()) >= config.MaxDocs {
+		return false
+	}
+	ctx.ids_chunk++
+	ctx.Query = current_query(config, ctx)
+	ctx.Cursor = nil
+	if config.Mode == "scroll" {
+		clear_scroll(config, ctx)
+		ctx.ScrollId = ""
+	}
+	config.debugf("Moving to chunk %d of ids", ctx.ids_chunk+1)
+	return true
+}
+
+// Counts the documents of every chunk of ids, or of the whole query without them
+func query_count(config *Config, ctx *Context) (int, error) {
+	if len(config.Ids) <= ids_chunk_size {
+		return query_count_database(config, ctx)
+	}
+	defer func(chunk int) {
+		ctx.ids_chunk = chunk
+		ctx.Query = current_query(config, ctx)
+	}(ctx.ids_chunk)
+	total := 0
+	for chunk := 0; chunk*ids_chunk_size < len(config.Ids); chunk++ {
+		ctx.ids_chunk = chunk
+		ctx.Query = current_query(config, ctx)
+		c, err := query_count_database(config, ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += c
+	}
+	return total, nil
+}
@@ -0,0 +1,107 @@
+package dump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Layout of the watermark, milliseconds are the precision of date fields
+const watermark_layout = "2006-01-02T15:04:05.000Z07:00"
+
+// Reads the newest time dumped by the previous run, zero if there was none
+func read_watermark(config *Config) (time.Time, error) {
+	data, err := os.ReadFile(config.WatermarkFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(watermark_layout, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid watermark in %s: %w", config.WatermarkFile, err)
+	}
+	return t, nil
+}
+
+// Checks that the files grown by appending and the watermark belong together, before anything is appended
+// A file without the watermark would get its documents again, a watermark without the file would leave them out,
+// and a file changed after the watermark was written has documents from a failed run, which would be appended twice
+func check_archive(config *Config, ctx *Context) error {
+	t, err := read_watermark(config)
+	if err != nil {
+		return err
+	}
+	marked, err := os.Stat(config.WatermarkFile)
+	for id := 0; id < config.Writers; id++ {
+		name := writer_name(config, ctx, id)
+		fi, ferr := os.Stat(name)
+		archived := ferr == nil && fi.Size() > 0
+		switch {
+		case archived && t.IsZero():
+			return fmt.Errorf("%s already has documents, but there is no watermark in %s, so they would be dumped again", name, config.WatermarkFile)
+		case !archived && !t.IsZero():
+			return fmt.Errorf("%s has a watermark, but %s is missing or empty, so the documents before it would be left out", config.WatermarkFile, name)
+		case archived && err == nil && fi.ModTime().After(marked.ModTime()):
+			return fmt.Errorf("%s was changed after the watermark in %s, a failed run may have appended documents that would be dumped again", name, config.WatermarkFile)
+		}
+	}
+	return nil
+}
+
+// Builds the filter selecting the documents newer than the watermark
+// The format is explicit, so that the mapping of the field does not matter
+func watermark_filter(config *Config, t time.Time) string {
+	field, _ := json.Marshal(config.Incremental)
+	return fmt.Sprintf(`{"range": {%s: {"gt": "%s", "format": "strict_date_optional_time"}}}`, field, t.UTC().Format(watermark_layout))
+}
+
+// Limits the query to the documents after the previous run
+func apply_watermark(config *Config, ctx *Context) error {
+	t, err := read_watermark(config)
+	if err != nil {
+		return err
+	}
+	ctx.Watermark = t
+	if t.IsZero() {
+		config.logf("No watermark in %s, dumping everything", config.WatermarkFile)
+		return nil
+	}
+	config.logf("Dumping documents with %s after %s", config.Incremental, t.UTC().Format(watermark_layout))
+	ctx.filters = append(ctx.filters, watermark_filter(config, t))
+	ctx.Query = current_query(config, ctx)
+	return nil
+}
+
+// Keeps track of the newest time of the dumped documents
+func observe_watermark(v *fastjson.Value, config *Config, ctx *Context) {
+	f := partition_field(v, config.Incremental)
+	if f == nil {
+		return
+	}
+	// Anything below a millisecond would be lost in the watermark, so the next run might dump it again, but never miss it
+	if t, ok := field_time(f); ok && t.After(ctx.Watermark) {
+		ctx.Watermark = t.Truncate(time.Millisecond)
+	}
+}
+
+// Records the newest time for the next run, replacing the file only once it is complete
+func write_watermark(config *Config, ctx *Context) error {
+	if ctx.Watermark.IsZero() {
+		return nil
+	}
+	tmp := config.WatermarkFile + partial_suffix
+	data := ctx.Watermark.UTC().Format(watermark_layout) + "\n"
+	if err := write_file(tmp, []byte(data), config); err != nil {
+		return err
+	}
+	config.debugf("Writing watermark %s to %s", ctx.Watermark.UTC().Format(watermark_layout), config.WatermarkFile)
+	return os.Rename(tmp, config.WatermarkFile)
+}
@@ -0,0 +1,57 @@
+package dump
+
+import (
+	"sort"
+	"time"
+)
+
+// Records the latency of a search window, warning about slow ones
+func record_latency(config *Config, ctx *Context, latency time.Duration) {
+	ctx.Latencies = append(ctx.Latencies, latency)
+	config.debugf("Window %d took %s", len(ctx.Latencies), latency)
+	if config.SlowWindow > 0 && latency > config.SlowWindow {
+		config.warnf("Window %d took %s, more than %s", len(ctx.Latencies), latency, config.SlowWindow)
+	}
+}
+
+// Logs the distribution of window latencies, for tuning the window size
+func log_latencies(config *Config, ctx *Context) {
+	if len(ctx.Latencies) == 0 {
+		return
+	}
+	sorted := append([]time.Duration{}, ctx.Latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	config.logf("Window latency over %d windows: min %s, median %s, p95 %s, max %s",
+		len(sorted), sorted[0], at(0.5), at(0.95), sorted[len(sorted)-1])
+}
+
+// Bounds of the window size when adapting it, the upper one being the default index.max_result_window
+const (
+	adaptive_min_size = 10
+	adaptive_max_size = 10000
+)
+
+// Adjusts the window size towards the target latency, at most doubling or halving it at once
+func adapt_size(config *Config, ctx *Context, latency time.Duration) {
+	if config.AdaptiveSize <= 0 || latency <= 0 {
+		return
+	}
+	factor := float64(config.AdaptiveSize) / float64(latency)
+	// Latencies vary between windows anyway, small differences are not worth reacting to
+	if factor > 0.8 && factor < 1.25 {
+		return
+	}
+	factor = min(max(factor, 0.5), 2)
+	upper := adaptive_max_size
+	if ctx.ResultWindow > 0 {
+		upper = min(upper, ctx.ResultWindow)
+	}
+	size := min(max(int(float64(ctx.Size)*factor), adaptive_min_size), upper)
+	if size != ctx.Size {
+		config.debugf("Window of %d took %s, adjusting size to %d", ctx.Size, latency, size)
+		ctx.Size = size
+	}
+}
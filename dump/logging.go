@@ -0,0 +1,65 @@
+package dump
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Log levels, from the most verbose
+var log_levels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// Tells whether messages at level are logged, -debug being the same as debug level
+func (config *Config) Enabled(level string) bool {
+	min, ok := log_levels[config.LogLevel]
+	if !ok {
+		min = log_levels["info"]
+	}
+	if config.Debug {
+		min = log_levels["debug"]
+	}
+	return log_levels[level] >= min
+}
+
+// Returns the configured logger, log.Default() if there is none
+func (config *Config) logger() *log.Logger {
+	if config.Logger == nil {
+		return log.Default()
+	}
+	return config.Logger
+}
+
+// Writes a log message at level, in the configured format
+//
+// The message is written regardless of the configured level, which Enabled tells.
+// Fields are key and value pairs, included only in the json format.
+// Calldepth works like in log.Logger.Output, 1 being the caller of Log.
+func (config *Config) Log(calldepth int, level string, msg string, fields ...interface{}) {
+	if config.LogFormat != "json" {
+		config.logger().Output(calldepth+1, msg)
+		return
+	}
+	line := map[string]interface{}{
+		"time":    time.Now().Format(time.RFC3339Nano),
+		"level":   level,
+		"message": msg,
+	}
+	if _, file, no, ok := runtime.Caller(calldepth); ok {
+		line["source"] = fmt.Sprintf("%s:%d", filepath.Base(file), no)
+	}
+	if config.Index != "" {
+		line["index"] = config.Index
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		line[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"level": level, "message": msg})
+	}
+	// The json carries its own timestamp, so the flags of the logger are bypassed
+	config.logger().Writer().Write(append(data, ln...))
+}
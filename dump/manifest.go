@@ -0,0 +1,75 @@
+package dump
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Describes a single output file
+type FileInfo struct {
+	Name string `json:"name"`
+	// Written by this run, also when appending
+	Documents int `json:"documents"`
+	// Size of the whole file, also when appending
+	Bytes int64 `json:"bytes"`
+	// Only calculated when writing a manifest, covers the whole file also when appending
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// Oldest and newest time of a field in the dumped documents
+type time_range struct {
+	Field string    `json:"field"`
+	Min   time.Time `json:"min"`
+	Max   time.Time `json:"max"`
+}
+
+// Sidecar describing a finished dump, for verifying it later
+type manifest struct {
+	// Set when the writers were stopped at the drain timeout, only the listed files are complete
+	Incomplete bool   `json:"incomplete,omitempty"`
+	Index      string `json:"index"`
+	Documents  int    `json:"documents"`
+	// Total of the files, so that it agrees with them also when appending
+	Bytes       int64       `json:"bytes"`
+	Compression string      `json:"compression"`
+	Started     time.Time   `json:"started"`
+	Finished    time.Time   `json:"finished"`
+	Range       *time_range `json:"range,omitempty"`
+	Files       []FileInfo  `json:"files"`
+}
+
+// Writes the manifest next to the output file
+func write_manifest(config *Config, ctx *Context, stats Stats, started time.Time, incomplete bool) error {
+	m := manifest{
+		Incomplete:  incomplete,
+		Index:       config.Index,
+		Documents:   stats.Count,
+		Compression: compression(config),
+		Started:     started,
+		Finished:    started.Add(stats.Duration),
+		Files:       stats.Files,
+	}
+	// Fetched documents may still have been in the channel, so only the ones in the finished files count
+	if incomplete {
+		m.Files = append([]FileInfo{}, m.Files...)
+		m.Documents = 0
+		for _, f := range m.Files {
+			m.Documents += f.Documents
+		}
+	}
+	for _, f := range m.Files {
+		m.Bytes += f.Bytes
+	}
+	if !stats.RangeMin.IsZero() {
+		m.Range = &time_range{Field: config.TrackRange, Min: stats.RangeMin.UTC(), Max: stats.RangeMax.UTC()}
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := ctx.File + ".manifest.json"
+	config.debugf("Writing manifest %s", name)
+	return write_file(name, append(data, ln...), config)
+}
@@ -0,0 +1,30 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Writes the mappings and settings of the index next to the output file
+func write_mapping(config *Config, ctx *Context) error {
+	for _, kind := range []string{"mapping", "settings"} {
+		uri := fmt.Sprintf("%s/%s/_%s", config.Base, escape_index(config.Index), kind)
+		body, err := http_get(uri, nil, config, ctx)
+		if err != nil {
+			return err
+		}
+		// Indented, as these are more likely to be read and edited by people than the data
+		buf := new(bytes.Buffer)
+		if err := json.Indent(buf, body, "", "  "); err != nil {
+			return fmt.Errorf("invalid %s response: %w", kind, err)
+		}
+		buf.Write(ln)
+		name := fmt.Sprintf("%s.%s.json", ctx.File, kind)
+		config.debugf("Writing %s %s", kind, name)
+		if err := write_file(name, buf.Bytes(), config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package dump
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Progress counters of dumps, served in the Prometheus text format
+//
+// All methods are safe to call on a nil Metrics, which counts nothing.
+type Metrics struct {
+	documents atomic.Int64
+	expected  atomic.Int64
+	bytes     atomic.Int64
+	windows   atomic.Int64
+	retries   atomic.Int64
+	// Start of the current run as unix nanoseconds, 0 before the first run
+	started atomic.Int64
+}
+
+func (m *Metrics) start(expected int) {
+	if m != nil {
+		m.expected.Store(int64(expected))
+		m.started.Store(time.Now().UnixNano())
+	}
+}
+
+func (m *Metrics) add_documents(n int) {
+	if m != nil {
+		m.documents.Add(int64(n))
+	}
+}
+
+func (m *Metrics) add_bytes(n int64) {
+	if m != nil {
+		m.bytes.Add(n)
+	}
+}
+
+func (m *Metrics) add_window() {
+	if m != nil {
+		m.windows.Add(1)
+	}
+}
+
+func (m *Metrics) add_retry() {
+	if m != nil {
+		m.retries.Add(1)
+	}
+}
+
+// Average speed since the current run started
+func (m *Metrics) speed() float64 {
+	started := m.started.Load()
+	if started == 0 {
+		return 0
+	}
+	elapsed := time.Since(time.Unix(0, started)).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(m.documents.Load()) / elapsed
+}
+
+// Serves the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name string, kind string, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("osdump_documents_total", "counter", "Documents dumped.", m.documents.Load())
+	metric("osdump_documents_expected", "gauge", "Documents the index reported before the current run.", m.expected.Load())
+	metric("osdump_bytes_written_total", "counter", "Bytes written to the output files, after compression.", m.bytes.Load())
+	metric("osdump_windows_total", "counter", "Search windows fetched.", m.windows.Load())
+	metric("osdump_retries_total", "counter", "Requests retried.", m.retries.Load())
+	metric("osdump_documents_per_second", "gauge", "Average documents per second since the current run started.", fmt.Sprintf("%.2f", m.speed()))
+}
@@ -0,0 +1,738 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Counts the bytes passing through to the underlying writer
+type counting_writer struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *counting_writer) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Where the bytes of an output file end up, a local file unless streaming to S3
+type destination interface {
+	io.Writer
+	// Makes what has been written so far durable, as far as the destination can
+	sync() error
+	// Ends the complete file, which then appears under its final name
+	commit() error
+	// Ends the incomplete file, keeping or removing what was written as configured
+	abort(config *Config)
+	// Ends a file nothing was written to, removing it unless it existed already
+	discard()
+}
+
+// Output file on the local disk
+type local_file struct {
+	name string
+	// Path being written, renamed to name when complete
+	path string
+	file *os.File
+}
+
+// Opens the local output file, under a temporary name unless appending
+func open_local_file(name string, config *Config) (destination, error) {
+	if err := make_parent(name, config); err != nil {
+		return nil, err
+	}
+	path := name
+	flags := os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	// The file is written under a temporary name, so that the final name always means a complete file
+	// Appending has to write into the existing file directly
+	if !config.Append {
+		if _, err := os.Lstat(name); err == nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		// Leftovers of an earlier failed run are overwritten
+		path = name + partial_suffix
+		flags = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flags, config.FileMode)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("directory %s of the output does not exist: %w", filepath.Dir(name), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The umask would loosen nothing, but could make the files stricter than asked, and appending keeps the existing mode
+	if !config.Append {
+		if err := f.Chmod(config.FileMode); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &local_file{name: name, path: path, file: f}, nil
+}
+
+func (l *local_file) Write(p []byte) (int, error) {
+	return l.file.Write(p)
+}
+
+func (l *local_file) sync() error {
+	return l.file.Sync()
+}
+
+func (l *local_file) commit() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.path != l.name {
+		return os.Rename(l.path, l.name)
+	}
+	return nil
+}
+
+func (l *local_file) abort(config *Config) {
+	l.file.Close()
+	if l.path == l.name {
+		return
+	}
+	if config.RemovePartial {
+		os.Remove(l.path)
+		return
+	}
+	config.warnf("Left incomplete output in %s", l.path)
+}
+
+func (l *local_file) discard() {
+	l.file.Close()
+	if l.path != l.name {
+		os.Remove(l.path)
+	}
+}
+
+// Holds one open output file, and the writers stacked on top of it
+type output struct {
+	name    string
+	dest    destination
+	hash    hash.Hash
+	buf     *bufio.Writer
+	counter *counting_writer
+	comp    io.WriteCloser
+	// Counts the bytes before compression
+	raw  *counting_writer
+	out  io.Writer
+	docs int
+	// Documents of the file when the current gzip member started
+	member int
+	// Set when a gzip member has ended, the next one starts only with the next document
+	ended bool
+	// Size of the file before appending to it
+	existing int64
+	// Quality of the compressor, which may differ between the files and gzip members
+	quality int
+}
+
+// Brackets around the documents of array format
+var (
+	array_open  = []byte("[")
+	array_close = []byte("\n]\n")
+)
+
+// Suffix of output files that are still being written
+const partial_suffix = ".partial"
+
+// Opens a new output file in the destination, compressing at the quality
+func open_output(name string, create func(string) (destination, error), config *Config, quality int) (*output, error) {
+	dest, err := create(name)
+	if err != nil {
+		return nil, err
+	}
+	o := &output{name: name, dest: dest, quality: quality}
+	if config.Append {
+		if fi, err := os.Stat(name); err == nil {
+			o.existing = fi.Size()
+		}
+	}
+	// Checksum of the bytes on disk is needed only for the manifest
+	if config.Manifest {
+		o.hash = sha256.New()
+		// When appending the checksum still has to cover the whole file
+		if config.Append {
+			if err := hash_file(name, o.hash); err != nil {
+				dest.discard()
+				return nil, err
+			}
+		}
+		o.buf = bufio.NewWriterSize(io.MultiWriter(dest, o.hash), config.WriteBuffer)
+	} else {
+		o.buf = bufio.NewWriterSize(dest, config.WriteBuffer)
+	}
+	// The counter sits below the compressor, so that it sees the bytes that actually end up on disk
+	o.counter = &counting_writer{w: o.buf}
+	// Build a writer that works both with straight buffering, and the compressors
+	// Apparently only io.Writer seems to be common with these writers
+	comp, err := new_compressor(o.counter, config, quality)
+	if err != nil {
+		dest.discard()
+		return nil, err
+	}
+	if comp != nil {
+		o.comp = comp
+		o.raw = &counting_writer{w: o.comp}
+	} else {
+		o.raw = &counting_writer{w: o.counter}
+	}
+	o.out = o.raw
+	if config.Format == "array" {
+		if _, err := o.out.Write(array_open); err != nil {
+			dest.discard()
+			return nil, err
+		}
+	}
+	config.debugf("Opened output file %s", name)
+	return o, nil
+}
+
+// Creates the missing parent directories of the file when asked to
+// The directories get the permissions of the files, searchable by whoever may read them
+func make_parent(name string, config *Config) error {
+	if !config.Mkdir {
+		return nil
+	}
+	mode := config.FileMode | (config.FileMode&0444)>>2
+	return os.MkdirAll(filepath.Dir(name), mode)
+}
+
+// Writes a sidecar file with the configured permissions
+func write_file(name string, data []byte, config *Config) error {
+	if err := make_parent(name, config); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, data, config.FileMode); err != nil {
+		return err
+	}
+	return os.Chmod(name, config.FileMode)
+}
+
+// Feeds the existing contents of the file to the hash
+func hash_file(name string, h hash.Hash) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// Ends the compressed stream and writes out the buffer, returning the first error
+func (o *output) flush_end() error {
+	var errs []error
+	if o.comp != nil && !o.ended {
+		errs = append(errs, o.comp.Close())
+	}
+	errs = append(errs, o.buf.Flush())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ends the array of documents, so that even an incomplete file is valid JSON
+func (o *output) finish(config *Config) error {
+	if config.Format == "array" {
+		if err := o.next_member(config, o.quality); err != nil {
+			return err
+		}
+		_, err := o.out.Write(array_close)
+		return err
+	}
+	return nil
+}
+
+// Writes out what the compressor and buffer hold, and syncs the file
+func (o *output) flush() error {
+	// All the compressors can flush, without ending their stream
+	if f, ok := o.comp.(interface{ Flush() error }); ok && !o.ended {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := o.buf.Flush(); err != nil {
+		return err
+	}
+	return o.dest.sync()
+}
+
+// Ends the gzip member, the next one is started by the next write, so that a file never ends with an empty member
+func (o *output) end_member() error {
+	if _, ok := o.comp.(interface{ Reset(io.Writer) }); !ok || o.ended {
+		return nil
+	}
+	o.ended = true
+	return o.comp.Close()
+}
+
+// Starts the next gzip member in the same file at the quality, if the previous one has ended
+func (o *output) next_member(config *Config, quality int) error {
+	if !o.ended {
+		return nil
+	}
+	o.ended = false
+	if quality == o.quality {
+		o.comp.(interface{ Reset(io.Writer) }).Reset(o.counter)
+		return nil
+	}
+	comp, err := new_compressor(o.counter, config, quality)
+	if err != nil {
+		return err
+	}
+	o.comp = comp
+	o.raw.w = comp
+	o.quality = quality
+	return nil
+}
+
+// Closes the complete output file, and gives it the final name
+func (o *output) close(config *Config) error {
+	if err := o.finish(config); err != nil {
+		return err
+	}
+	if err := o.flush_end(); err != nil {
+		o.dest.abort(config)
+		return err
+	}
+	return o.dest.commit()
+}
+
+// Closes the incomplete output file, leaving it under the temporary name unless removing was configured
+func (o *output) abort(config *Config) {
+	o.finish(config)
+	o.flush_end()
+	o.dest.abort(config)
+}
+
+// Closes an output file nothing was written to, and removes it unless it existed already
+func (o *output) discard() {
+	if o.comp != nil && !o.ended {
+		o.comp.Close()
+	}
+	o.dest.discard()
+}
+
+// Writes what goes before the next document of array format, the documents are on lines of their own
+func (o *output) separate(config *Config) error {
+	if config.Format != "array" {
+		return nil
+	}
+	sep := ln
+	if o.docs > 0 {
+		sep = []byte(",\n")
+	}
+	_, err := o.out.Write(sep)
+	return err
+}
+
+// Tells whether the output file has reached the configured limits, next is the size of the next document
+func (o *output) full(config *Config, next int) bool {
+	// Bulk requests have to stay under the limits, so the next document is taken into account
+	if config.BulkActions > 0 && o.docs >= config.BulkActions {
+		return true
+	}
+	if config.BulkSize > 0 && o.docs > 0 && o.raw.count+int64(next+len(config.Delimiter)) > config.BulkSize {
+		return true
+	}
+	if config.MaxDocsPerFile > 0 {
+		return o.docs >= config.MaxDocsPerFile
+	}
+	if config.MaxFileSize > 0 {
+		return o.counter.count >= config.MaxFileSize
+	}
+	return false
+}
+
+// Compression extensions that stay at the end of file names
+var compression_extensions = []string{".br", ".gz", ".zst"}
+
+// Splits file name into stem and extension, keeping compression extension with the extension
+func split_ext(name string) (string, string) {
+	comp := ""
+	for _, e := range compression_extensions {
+		if strings.HasSuffix(name, e) {
+			comp = e
+			name = strings.TrimSuffix(name, e)
+			break
+		}
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext), ext + comp
+}
+
+// Returns the base file name of the numbered consumer
+func writer_name(config *Config, ctx *Context, id int) string {
+	if config.Writers > 1 {
+		stem, ext := split_ext(ctx.File)
+		return fmt.Sprintf("%s-%d%s", stem, id, ext)
+	}
+	return ctx.File
+}
+
+// Tells whether the output is split into several files
+func split(config *Config) bool {
+	return config.MaxFileSize > 0 || config.MaxDocsPerFile > 0 || config.BulkActions > 0 || config.BulkSize > 0
+}
+
+// Returns the tuning of the compression quality, nil unless it is automatic
+func auto_quality(config *Config, ctx *Context) func() int {
+	if !config.AutoQuality {
+		return nil
+	}
+	return func() int { return ctx.tune_quality(config) }
+}
+
+// Returns how the output files are created, streamed to S3 or on the local disk
+func destinations(config *Config, ctx *Context) func(string) (destination, error) {
+	if config.S3Stream {
+		return func(name string) (destination, error) { return open_s3_object(name, config, ctx) }
+	}
+	return func(name string) (destination, error) { return open_local_file(name, config) }
+}
+
+// Returns the name of the output file for part number
+func part_name(name string, config *Config, part int) string {
+	if split(config) {
+		return fmt.Sprintf("%s.%03d", name, part)
+	}
+	return name
+}
+
+// A series of numbered output files sharing a base name
+type sink struct {
+	name  string
+	parts int
+	bytes int64
+	raw   int64
+	files []FileInfo
+	out   *output
+	// Picks the compression quality of every file and member, nil for the configured one
+	tune func() int
+	// Creates the files in their destination
+	create func(string) (destination, error)
+}
+
+// Returns the compression quality for the next file or member
+func (s *sink) quality(config *Config) int {
+	if s.tune == nil {
+		return config.Quality
+	}
+	return s.tune()
+}
+
+// Opens the next numbered output file
+func (s *sink) open(config *Config) error {
+	o, err := open_output(part_name(s.name, config, s.parts), s.create, config, s.quality(config))
+	if err != nil {
+		return err
+	}
+	s.out = o
+	s.parts++
+	return nil
+}
+
+// Writes a document, rolling over to the next file when the current one is full
+func (s *sink) write(data []byte, config *Config) error {
+	// Roll over before writing, so that documents are never split between files
+	if s.out.full(config, len(data)) {
+		if err := s.close(config); err != nil {
+			return err
+		}
+		if err := s.open(config); err != nil {
+			return err
+		}
+	}
+	if err := s.out.next_member(config, s.quality(config)); err != nil {
+		return err
+	}
+	before := s.out.counter.count
+	if err := s.out.separate(config); err != nil {
+		return err
+	}
+	if _, err := s.out.out.Write(data); err != nil {
+		return err
+	}
+	if config.Format != "array" {
+		if _, err := io.WriteString(s.out.out, config.Delimiter); err != nil {
+			return err
+		}
+	}
+	s.out.docs++
+	config.Metrics.add_documents(1)
+	config.Metrics.add_bytes(s.out.counter.count - before)
+	return nil
+}
+
+// Closes the current output file, and adds its size to the totals
+func (s *sink) close(config *Config) error {
+	if s.out == nil {
+		return nil
+	}
+	before := s.out.counter.count
+	err := s.out.close(config)
+	// Compressors and buffers write the rest only when closing
+	config.Metrics.add_bytes(s.out.counter.count - before)
+	s.bytes += s.out.counter.count
+	s.raw += s.out.raw.count
+	// The size and checksum describe the whole file, the documents only the ones written now
+	info := FileInfo{Name: s.out.name, Documents: s.out.docs, Bytes: s.out.existing + s.out.counter.count}
+	if s.out.hash != nil {
+		info.Sha256 = hex.EncodeToString(s.out.hash.Sum(nil))
+	}
+	s.files = append(s.files, info)
+	s.out = nil
+	return err
+}
+
+// Stops writing after a failure, the incomplete file is not counted
+func (s *sink) abort(config *Config) {
+	if s.out != nil {
+		s.out.abort(config)
+		s.out = nil
+	}
+}
+
+// Flushes the current files of all the sinks
+func flush_sinks(sinks map[string]*sink, config *Config) error {
+	for _, s := range sinks {
+		if s.out == nil {
+			continue
+		}
+		before := s.out.counter.count
+		if err := s.out.flush(); err != nil {
+			return err
+		}
+		config.Metrics.add_bytes(s.out.counter.count - before)
+	}
+	return nil
+}
+
+// Ends the gzip members of the sinks that have documents in them, the next ones start with the next document
+func end_members(sinks map[string]*sink, config *Config) error {
+	for _, s := range sinks {
+		// A window can go entirely to the other writers or buckets, and empty members would only waste space
+		if s.out == nil || s.out.docs == s.out.member {
+			continue
+		}
+		before := s.out.counter.count
+		if err := s.out.end_member(); err != nil {
+			return err
+		}
+		s.out.member = s.out.docs
+		config.Metrics.add_bytes(s.out.counter.count - before)
+	}
+	return nil
+}
+
+// Closes all the sinks, returning the first error
+func close_sinks(sinks map[string]*sink, config *Config) error {
+	var first error
+	for _, s := range sinks {
+		if err := s.close(config); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Opens the first output file of every consumer, partitioned outputs are opened when the first document arrives
+func open_sinks(config *Config, ctx *Context) ([]map[string]*sink, error) {
+	all := make([]map[string]*sink, config.Writers)
+	for id := range all {
+		all[id] = map[string]*sink{}
+		if config.PartitionBy != "" {
+			continue
+		}
+		s := &sink{name: writer_name(config, ctx, id), tune: auto_quality(config, ctx), create: destinations(config, ctx)}
+		if err := s.open(config); err != nil {
+			discard_sinks(all)
+			return nil, err
+		}
+		all[id][""] = s
+	}
+	return all, nil
+}
+
+// Removes the output files of a dump that failed before writing anything
+func discard_sinks(all []map[string]*sink) {
+	for _, sinks := range all {
+		for _, s := range sinks {
+			if s.out != nil {
+				s.out.discard()
+				s.out = nil
+			}
+		}
+	}
+}
+
+// Fails on a raw line feed in the document with -strict-ndjson, it would break the one document per line contract
+// Marshaling keeps strings as the cluster sent them, so a lenient one would put it into the output as is
+func check_ndjson(data []byte, config *Config) error {
+	if !config.StrictNdjson {
+		return nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return fmt.Errorf("refusing to write a document with a raw line feed at byte %d: %s", i, truncate(data, error_body_limit))
+	}
+	return nil
+}
+
+// Reads results from a channel and writes them into the sinks opened for it
+func consumer(ctx *Context, config *Config, id int, sinks map[string]*sink) error {
+	// Each bucket of partitioned output has its own series of files
+	name := writer_name(config, ctx, id)
+	get := func(bucket string) (*sink, error) {
+		if s, ok := sinks[bucket]; ok {
+			return s, nil
+		}
+		s := &sink{name: partition_name(name, bucket), tune: auto_quality(config, ctx), create: destinations(config, ctx)}
+		if err := s.open(config); err != nil {
+			return nil, err
+		}
+		sinks[bucket] = s
+		return s, nil
+	}
+	defer func() {
+		for _, s := range sinks {
+			ctx.add_output(s)
+		}
+	}()
+	// Parsers are not safe for concurrent use, so consumers have their own
+	var parser fastjson.Parser
+
+	write := func(data []byte) error {
+		// A single broken line can poison whole loads downstream, so it is better to fail here
+		if config.ValidateOutput {
+			if err := fastjson.ValidateBytes(data); err != nil {
+				return fmt.Errorf("refusing to write a document that is not valid JSON: %w: %s", err, truncate(data, error_body_limit))
+			}
+		}
+		if err := check_ndjson(data, config); err != nil {
+			return err
+		}
+		bucket := ""
+		if config.PartitionBy != "" {
+			bucket = partition(&parser, data, config)
+		}
+		if config.Format == "bulk" {
+			entry, err := bulk_entry(&parser, data)
+			if err != nil {
+				return err
+			}
+			data = entry
+		}
+		s, err := get(bucket)
+		if err != nil {
+			return err
+		}
+		return s.write(data, config)
+	}
+	// Flushing lets the files be read, and survive a crash, during long dumps
+	var flush <-chan time.Time
+	if config.FlushInterval > 0 {
+		ticker := time.NewTicker(config.FlushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	// The last documents of a window may still be in the channel when it has been sent
+	var window <-chan struct{}
+	if ctx.windows != nil {
+		window = ctx.windows[id]
+	}
+	window_pending := false
+	// A member per window lets tools index the file, and decompress parts of it in parallel
+	// Window of the documents in the current gzip members, -1 for none
+	member_window := int64(-1)
+
+	// Documents pile up in the channel until the prefetch is done
+	select {
+	case <-ctx.writing:
+	case <-ctx.Ctx.Done():
+	}
+
+	// Write received data
+loop:
+	for {
+		var err error
+		select {
+		case t, ok := <-*ctx.Tasks:
+			if !ok {
+				break loop
+			}
+			// The batches of a window come in a row, so the members end exactly where the windows of this writer change
+			if config.GzipMembers && t.window != member_window {
+				err = end_members(sinks, config)
+				member_window = t.window
+			}
+			for _, data := range t.docs {
+				if err != nil {
+					break
+				}
+				err = write(data)
+			}
+			ctx.taken.Add(int64(len(t.docs)))
+		case <-flush:
+			err = flush_sinks(sinks, config)
+		case <-ctx.drain_expired:
+			// The files are aborted below, like when the channel is closed after a failure
+			break loop
+		case <-window:
+			// Not waiting for a channel that the producer keeps ahead of the writing
+			if window_pending && len(*ctx.Tasks) > 0 && config.FlushEachWindow {
+				err = flush_sinks(sinks, config)
+			}
+			window_pending = true
+		}
+		// Loaded before looking at the channel, so that the windows counted complete had all been sent by then
+		if done := ctx.completed.Load(); err == nil && window_pending && len(*ctx.Tasks) == 0 {
+			// Every batch of the window has been taken, so the members of this writer need not wait for the next one
+			if config.GzipMembers && member_window >= 0 && member_window < done {
+				err = end_members(sinks, config)
+				member_window = -1
+			}
+			if err == nil && config.FlushEachWindow {
+				err = flush_sinks(sinks, config)
+			}
+			window_pending = false
+		}
+		if err != nil {
+			for _, s := range sinks {
+				s.abort(config)
+			}
+			return err
+		}
+	}
+	// The channel is closed also when the producer failed, the files are then incomplete
+	if err := ctx.Ctx.Err(); err != nil {
+		for _, s := range sinks {
+			s.abort(config)
+		}
+		return err
+	}
+	if err := close_sinks(sinks, config); err != nil {
+		return err
+	}
+	config.debugf("Consumer %d done", id)
+	return nil
+}
@@ -0,0 +1,230 @@
+package dump
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+func TestPartNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		id     int
+		want   string
+	}{
+		{"single file", Config{Writers: 1}, 0, "/d/e.json"},
+		{"split", Config{Writers: 1, MaxFileSize: 1 << 20}, 0, "/d/e.json.002"},
+		{"writer", Config{Writers: 3}, 1, "/d/e-1.json"},
+		{"writer, split", Config{Writers: 3, MaxDocsPerFile: 10}, 2, "/d/e-2.json.002"},
+		{"bulk split", Config{Writers: 1, BulkActions: 1000}, 0, "/d/e.json.002"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := writer_name(&tt.config, &Context{File: "/d/e.json"}, tt.id)
+			if got := part_name(name, &tt.config, 2); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitExt(t *testing.T) {
+	tests := []struct {
+		name string
+		stem string
+		ext  string
+	}{
+		{"e.json", "e", ".json"},
+		{"/d/e.ndjson.gz", "/d/e", ".ndjson.gz"},
+		{"e.json.zst", "e", ".json.zst"},
+		{"e.bulk.br", "e", ".bulk.br"},
+		{"e.gz", "e", ".gz"},
+		{"e", "e", ""},
+		{"/d.v1/e.json", "/d.v1/e", ".json"},
+	}
+	for _, tt := range tests {
+		stem, ext := split_ext(tt.name)
+		if stem != tt.stem || ext != tt.ext {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, stem, ext, tt.stem, tt.ext)
+		}
+		// Writers number their files between the two, so the extension must stay intact
+		if got, want := writer_name(&Config{Writers: 2}, &Context{File: tt.name}, 1), tt.stem+"-1"+tt.ext; got != want {
+			t.Errorf("%s: writer file %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		docs   int
+		raw    int64
+		size   int64
+		next   int
+		full   bool
+	}{
+		{"not split", Config{}, 1000000, 1 << 40, 1 << 40, 100, false},
+		{"below max file size", Config{MaxFileSize: 1000}, 10, 5000, 999, 100, false},
+		{"at max file size", Config{MaxFileSize: 1000}, 10, 5000, 1000, 100, true},
+		{"below max docs", Config{MaxDocsPerFile: 10}, 9, 0, 0, 100, false},
+		{"at max docs", Config{MaxDocsPerFile: 10}, 10, 0, 0, 100, true},
+		{"max docs before size", Config{MaxDocsPerFile: 10, MaxFileSize: 1000}, 9, 5000, 5000, 100, false},
+		{"at bulk actions", Config{BulkActions: 10}, 10, 0, 0, 100, true},
+		{"below bulk actions", Config{BulkActions: 10}, 9, 0, 0, 100, false},
+		{"next fits bulk size", Config{BulkSize: 1000, Delimiter: "\n"}, 5, 899, 0, 100, false},
+		{"next overflows bulk size", Config{BulkSize: 1000, Delimiter: "\n"}, 5, 900, 0, 100, true},
+		{"first document over bulk size", Config{BulkSize: 1000, Delimiter: "\n"}, 0, 0, 0, 2000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &output{docs: tt.docs, raw: &counting_writer{count: tt.raw}, counter: &counting_writer{count: tt.size}}
+			if got := o.full(&tt.config, tt.next); got != tt.full {
+				t.Errorf("full %t, want %t", got, tt.full)
+			}
+		})
+	}
+}
+
+func TestRollover(t *testing.T) {
+	for _, file := range []string{"e.ndjson.gz", "e.json.zst"} {
+		t.Run(file, func(t *testing.T) {
+			dir := t.TempDir()
+			config := &Config{Index: "graylog_0", File: file, Dir: dir, Base: "http://localhost:9200", Size: 100, MaxDocsPerFile: 2, Writers: 2}
+			d, err := new_dumper(config, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config = d.config
+			ctx := d.new_context(context.Background())
+			ctx.File = filepath.Join(dir, file)
+			s := &sink{name: writer_name(config, ctx, 1), create: destinations(config, ctx)}
+			if err := s.open(config); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				if err := s.write([]byte(fmt.Sprintf(`{"i":%d}`, i)), config); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.close(config); err != nil {
+				t.Fatal(err)
+			}
+			stem, ext := split_ext(file)
+			var want []string
+			for part := 0; part < 3; part++ {
+				want = append(want, fmt.Sprintf("%s-1%s.%03d", stem, ext, part))
+			}
+			var got []string
+			for _, f := range s.files {
+				got = append(got, filepath.Base(f.Name))
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("parts %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGzipMembersPerWindow(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{Index: "graylog_0", File: "e.json.gz", Dir: dir, Base: "http://localhost:9200", Size: 100, Gzip: true, GzipMembers: true, Writers: 3, Batch: 4, ChannelBuffer: 64}
+	d, err := new_dumper(config, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = d.config
+	ctx := d.new_context(context.Background())
+	ctx.File = filepath.Join(dir, "e.json.gz")
+	sinks, err := open_sinks(config, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.start_writing(config)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Writers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if err := consumer(ctx, config, id, sinks[id]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// Windows of various sizes, some sent faster than written and some after a pause
+	for w := 0; w < 40; w++ {
+		for b := 0; b < 1+w%5; b++ {
+			batch := make([][]byte, config.Batch)
+			for i := range batch {
+				batch[i] = []byte(fmt.Sprintf(`{"w":%d,"i":%d}`, w, b*config.Batch+i))
+			}
+			if err := send(batch, config, ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx.window_sent(config)
+		if w%7 == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	close(*ctx.Tasks)
+	wg.Wait()
+
+	names, err := filepath.Glob(filepath.Join(dir, "e-*.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != config.Writers {
+		t.Fatalf("%d files for %d writers: %v", len(names), config.Writers, names)
+	}
+	docs := 0
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Windows of this writer, in the order of its members
+		last := -1
+		r := bytes.NewReader(data)
+		for member := 0; r.Len() > 0; member++ {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatalf("%s member %d: %s", name, member, err)
+			}
+			zr.Multistream(false)
+			content, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%s member %d: %s", name, member, err)
+			}
+			window := -1
+			for _, line := range bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n")) {
+				w := fastjson.MustParseBytes(line).GetInt("w")
+				if window == -1 {
+					window = w
+				} else if w != window {
+					t.Errorf("%s member %d has windows %d and %d", name, member, window, w)
+				}
+				docs++
+			}
+			// A window split across consecutive members would show up twice in a row
+			if window <= last {
+				t.Errorf("%s member %d has window %d after window %d", name, member, window, last)
+			}
+			last = window
+		}
+	}
+	if want := int(ctx.sent); docs != want {
+		t.Errorf("%d documents in the members, want %d", docs, want)
+	}
+}
@@ -0,0 +1,96 @@
+package dump
+
+import (
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Bucket of documents without a usable partition field
+const unpartitioned = "unpartitioned"
+
+// Layouts of the time field values, in the order they are tried
+var partition_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05.000Z0700",
+	"2006-01-02",
+}
+
+// Returns the layout of bucket names for the granularity
+func bucket_layout(config *Config) string {
+	if config.PartitionGranularity == "hour" {
+		return "2006-01-02T15"
+	}
+	return "2006-01-02"
+}
+
+// Finds the partition field of the document, with dots separating nested objects
+func partition_field(doc *fastjson.Value, field string) *fastjson.Value {
+	// Flattened field names with dots are looked up as they are first
+	if v := doc.Get("_source", field); v != nil {
+		return v
+	}
+	return doc.Get(append([]string{"_source"}, strings.Split(field, ".")...)...)
+}
+
+// Returns the time of a date field, numbers are epoch milliseconds
+func field_time(v *fastjson.Value) (time.Time, bool) {
+	switch v.Type() {
+	case fastjson.TypeNumber:
+		return time.UnixMilli(v.GetInt64()), true
+	case fastjson.TypeString:
+		s := string(v.GetStringBytes())
+		for _, layout := range partition_layouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Keeps track of the oldest and newest time of the tracked field, for checking what the dump covered
+func observe_range(v *fastjson.Value, config *Config, ctx *Context) {
+	f := partition_field(v, config.TrackRange)
+	if f == nil {
+		return
+	}
+	t, ok := field_time(f)
+	if !ok {
+		return
+	}
+	if ctx.RangeMin.IsZero() || t.Before(ctx.RangeMin) {
+		ctx.RangeMin = t
+	}
+	if t.After(ctx.RangeMax) {
+		ctx.RangeMax = t
+	}
+}
+
+// Returns the time bucket of the document, in UTC
+func partition(parser *fastjson.Parser, data []byte, config *Config) string {
+	doc, err := parser.ParseBytes(data)
+	if err != nil {
+		return unpartitioned
+	}
+	v := partition_field(doc, config.PartitionBy)
+	if v == nil {
+		return unpartitioned
+	}
+	if t, ok := field_time(v); ok {
+		return t.UTC().Format(bucket_layout(config))
+	}
+	return unpartitioned
+}
+
+// Returns the base file name of the bucket
+func partition_name(name string, bucket string) string {
+	if bucket == "" {
+		return name
+	}
+	stem, ext := split_ext(name)
+	return stem + "-" + bucket + ext
+}
@@ -0,0 +1,56 @@
+package dump
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// How long the cluster keeps the point in time alive between windows, the query template renews it with the same value
+const pit_keepalive = "1m"
+
+// Opens a point in time, so that every window sees the same snapshot of the data
+func open_pit(config *Config, ctx *Context) error {
+	uri := with_shards(fmt.Sprintf("%s/%s/_search/point_in_time?keep_alive=%s", config.Base, escape_index(config.Index), pit_keepalive), config)
+	field := "pit_id"
+	// Elasticsearch has its own endpoint, and calls the id just id
+	if elasticsearch(config, ctx) {
+		uri = with_shards(fmt.Sprintf("%s/%s/_pit?keep_alive=%s", config.Base, escape_index(config.Index), pit_keepalive), config)
+		field = "id"
+	}
+	body, err := http_request("POST", uri, nil, config, ctx)
+	if err != nil {
+		return err
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return err
+	}
+	id := json.GetStringBytes(field)
+	if id == nil {
+		return fmt.Errorf("point in time response has no %s", field)
+	}
+	ctx.PitId = string(id)
+	config.debugf("Opened point in time %s", ctx.PitId)
+	return nil
+}
+
+// Releases the point in time, it would expire eventually anyway
+func close_pit(config *Config, ctx *Context) {
+	if ctx.PitId == "" {
+		return
+	}
+	uri := fmt.Sprintf("%s/_search/point_in_time", config.Base)
+	body, err := json.Marshal(map[string][]string{"pit_id": {ctx.PitId}})
+	if elasticsearch(config, ctx) {
+		uri = fmt.Sprintf("%s/_pit", config.Base)
+		body, err = json.Marshal(map[string]string{"id": ctx.PitId})
+	}
+	if err == nil {
+		_, err = http_request("DELETE", uri, body, config, ctx)
+	}
+	if err != nil {
+		config.warnf("Closing point in time failed: %s", err)
+		return
+	}
+	config.debugf("Closed point in time")
+}
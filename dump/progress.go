@@ -0,0 +1,23 @@
+package dump
+
+import "time"
+
+// Snapshot of a running dump
+type Progress struct {
+	Index string
+	// Documents dumped so far
+	Count int
+	// Documents the index reported, 0 until counted
+	Expected int
+	Elapsed  time.Duration
+}
+
+// Returns the progress of the dump in progress, zero if none is running
+// Safe to call from other goroutines while Run is going on
+func (d *Dumper) Progress() Progress {
+	ctx := d.running.Load()
+	if ctx == nil {
+		return Progress{}
+	}
+	return Progress{Index: d.config.Index, Count: int(ctx.Counter.Load()), Expected: int(ctx.Expected.Load()), Elapsed: time.Since(ctx.Started)}
+}
@@ -0,0 +1,34 @@
+package dump
+
+import (
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// Replaces the values of masked fields
+var mask_value = fastjson.MustParse(`"[REDACTED]"`)
+
+// Finds the object containing the field of the dot-path in _source, and the key of the field
+func field_parent(hit *fastjson.Value, path string) (*fastjson.Value, string) {
+	keys := strings.Split(path, ".")
+	parent := hit.Get(append([]string{"_source"}, keys[:len(keys)-1]...)...)
+	if parent == nil || parent.Type() != fastjson.TypeObject {
+		return nil, ""
+	}
+	return parent, keys[len(keys)-1]
+}
+
+// Removes and masks the configured fields of a hit
+func redact(hit *fastjson.Value, config *Config) {
+	for _, path := range config.RedactFields {
+		if parent, key := field_parent(hit, path); parent != nil {
+			parent.Del(key)
+		}
+	}
+	for _, path := range config.MaskFields {
+		if parent, key := field_parent(hit, path); parent != nil && parent.Exists(key) {
+			parent.Set(key, mask_value)
+		}
+	}
+}
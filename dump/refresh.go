@@ -0,0 +1,25 @@
+package dump
+
+import (
+	"fmt"
+)
+
+// Refreshes the index, so that the documents indexed just before the dump are searchable
+func refresh_index(config *Config, ctx *Context) error {
+	uri := fmt.Sprintf("%s/%s/_refresh", config.Base, escape_index(config.Index))
+	body, err := http_request("POST", uri, nil, config, ctx)
+	if err != nil {
+		return err
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return err
+	}
+	// Shards that failed to refresh are still searched, just without the latest documents
+	if failed := json.GetInt("_shards", "failed"); failed > 0 {
+		config.warnf("Refreshing %s failed on %d of %d shards", config.Index, failed, json.GetInt("_shards", "total"))
+		return nil
+	}
+	config.logf("Refreshed %s", config.Index)
+	return nil
+}
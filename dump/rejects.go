@@ -0,0 +1,93 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/valyala/fastjson"
+)
+
+// Documents left out of the dump on purpose, with the reason, so that nothing disappears without a trace
+type rejects struct {
+	name  string
+	file  *os.File
+	buf   *bufio.Writer
+	count int
+	line  []byte
+}
+
+// Creates the rejects file, refusing to overwrite an existing one like the output
+func open_rejects(name string, config *Config) (*rejects, error) {
+	if err := make_parent(name, config); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, config.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(config.FileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rejects{name: name, file: f, buf: bufio.NewWriterSize(f, config.WriteBuffer)}, nil
+}
+
+// Records the hit as rejected, nothing is recorded without a rejects file
+// The hit is redacted first, the rejects must not leak what the output does not have
+func (r *rejects) add(hit *fastjson.Value, reason string, config *Config) error {
+	if r == nil {
+		return nil
+	}
+	if hit.Exists("sort") {
+		hit.Del("sort")
+	}
+	redact(hit, config)
+	reason_json, _ := json.Marshal(reason)
+	r.line = append(append(append(r.line[:0], `{"reason":`...), reason_json...), `,"hit":`...)
+	r.line = hit.MarshalTo(r.line)
+	r.line = append(r.line, "}\n"...)
+	if _, err := r.buf.Write(r.line); err != nil {
+		return err
+	}
+	r.count++
+	return nil
+}
+
+// Records a response that could not be parsed, nothing is recorded without a rejects file
+// It cannot be redacted, so only the reason is recorded when fields are redacted or masked
+func (r *rejects) add_response(body []byte, err error, config *Config) error {
+	if r == nil {
+		return nil
+	}
+	r.line = append(r.line[:0], `{"reason":"malformed response"`...)
+	if len(config.RedactFields) == 0 && len(config.MaskFields) == 0 {
+		error_json, _ := json.Marshal(err.Error())
+		response_json, _ := json.Marshal(string(body))
+		r.line = append(append(append(append(r.line, `,"error":`...), error_json...), `,"response":`...), response_json...)
+	}
+	r.line = append(r.line, "}\n"...)
+	_, werr := r.buf.Write(r.line)
+	return werr
+}
+
+// Writes out and closes the rejects file
+func (r *rejects) close(config *Config) error {
+	if r == nil {
+		return nil
+	}
+	err := r.buf.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	config.logf("Wrote %d rejected documents to %s", r.count, r.name)
+	return err
+}
+
+// Returns the number of rejected documents written
+func (r *rejects) counted() int {
+	if r == nil {
+		return 0
+	}
+	return r.count
+}
@@ -0,0 +1,176 @@
+package dump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Splits s3://bucket/prefix into the bucket and the prefix of the keys
+func parse_s3_uri(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URI %q, expected s3://bucket/prefix/", uri)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// Returns the key of the file under the prefix, keeping its path under the output directory
+// so that files split into directories do not collide, a file outside of it is keyed by its name
+func s3_key(prefix string, root string, name string) string {
+	// Relative paths are relative to the working directory, whether the file or the directory was given that way
+	key := filepath.Base(name)
+	abs_root, rerr := filepath.Abs(root)
+	abs_name, nerr := filepath.Abs(name)
+	if rerr == nil && nerr == nil {
+		if rel, err := filepath.Rel(abs_root, abs_name); err == nil && filepath.IsLocal(rel) {
+			key = rel
+		}
+	}
+	key = filepath.ToSlash(key)
+	if prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key
+}
+
+// Returns the files written by the dump, which are uploaded when it is complete
+// Streamed output files have been uploaded already, only the files next to them are left
+func written_files(config *Config, ctx *Context, stats Stats) []string {
+	var names []string
+	for _, f := range stats.Files {
+		if !config.S3Stream {
+			names = append(names, f.Name)
+		}
+	}
+	if config.WithMapping {
+		names = append(names, ctx.File+".mapping.json", ctx.File+".settings.json")
+	}
+	if config.Manifest {
+		names = append(names, ctx.File+".manifest.json")
+	}
+	return names
+}
+
+// Builds the uploader once for the dump, credentials come from the default chain of the AWS SDK
+// Large files are uploaded in parts, so they are never read into memory whole
+func s3_uploader(config *Config, ctx *Context) (*manager.Uploader, error) {
+	ctx.s3_once.Do(func() {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx.Ctx)
+		if err != nil {
+			ctx.s3_err = err
+			return
+		}
+		ctx.s3 = manager.NewUploader(s3.NewFromConfig(cfg), func(u *manager.Uploader) {
+			u.PartSize = config.S3PartSize
+		})
+	})
+	return ctx.s3, ctx.s3_err
+}
+
+// Uploads the files under the prefix of the S3 URI
+func upload_s3(names []string, config *Config, ctx *Context) error {
+	if len(names) == 0 {
+		return nil
+	}
+	bucket, prefix, err := parse_s3_uri(config.S3Uri)
+	if err != nil {
+		return err
+	}
+	uploader, err := s3_uploader(config, ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		key := s3_key(prefix, config.Dir, name)
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		_, err = uploader.Upload(ctx.Ctx, &s3.PutObjectInput{Bucket: &bucket, Key: &key, Body: f})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("uploading %s to s3://%s/%s failed: %w", name, bucket, key, err)
+		}
+		config.logf("Uploaded %s to s3://%s/%s", name, bucket, key)
+	}
+	return nil
+}
+
+// Tells the upload that the output file was not completed
+var errUploadAborted = errors.New("output file was not completed")
+
+// Output file streamed into a multipart upload as it is written, without a local copy
+// The object appears under its key only when the upload completes, like a local file under its final name
+type s3_object struct {
+	uri  string
+	pipe *io.PipeWriter
+	done chan error
+}
+
+// Starts uploading the output file under the prefix of the S3 URI, the uploader reads it in parts as it is written
+func open_s3_object(name string, config *Config, ctx *Context) (destination, error) {
+	bucket, prefix, err := parse_s3_uri(config.S3Uri)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := s3_uploader(config, ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := s3_key(prefix, config.Dir, name)
+	r, w := io.Pipe()
+	o := &s3_object{uri: fmt.Sprintf("s3://%s/%s", bucket, key), pipe: w, done: make(chan error, 1)}
+	go func() {
+		// Writing in the middle of stopping still completes or aborts the upload, instead of leaving parts behind
+		_, err := uploader.Upload(context.WithoutCancel(ctx.Ctx), &s3.PutObjectInput{Bucket: &bucket, Key: &key, Body: r})
+		// A failed upload fails the writing too, instead of blocking it
+		if err != nil {
+			r.CloseWithError(err)
+		}
+		o.done <- err
+	}()
+	return o, nil
+}
+
+func (o *s3_object) Write(p []byte) (int, error) {
+	n, err := o.pipe.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("uploading to %s failed: %w", o.uri, err)
+	}
+	return n, nil
+}
+
+// The parts are uploaded as they fill up, until then they are only in memory
+func (o *s3_object) sync() error {
+	return nil
+}
+
+func (o *s3_object) commit() error {
+	o.pipe.Close()
+	if err := <-o.done; err != nil {
+		return fmt.Errorf("uploading to %s failed: %w", o.uri, err)
+	}
+	return nil
+}
+
+// The uploaded parts are removed, so nothing is left of the incomplete file
+func (o *s3_object) abort(config *Config) {
+	o.pipe.CloseWithError(errUploadAborted)
+	<-o.done
+	config.warnf("Aborted the upload of incomplete output to %s", o.uri)
+}
+
+func (o *s3_object) discard() {
+	o.pipe.CloseWithError(errUploadAborted)
+	<-o.done
+}
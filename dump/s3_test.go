@@ -0,0 +1,30 @@
+package dump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestS3Key(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix, root, name, key string
+	}{
+		{"", "", "graylog_0.json", "graylog_0.json"},
+		{"opensearch", "", "2024-01-15/graylog_0.json", "opensearch/2024-01-15/graylog_0.json"},
+		{"opensearch", "", filepath.Join(wd, "graylog_0", "part-1.json"), "opensearch/graylog_0/part-1.json"},
+		{"opensearch", "/backup/20240115T000000", "/backup/20240115T000000/graylog_1/graylog_1.json", "opensearch/graylog_1/graylog_1.json"},
+		{"opensearch", "out", "out/graylog_0.json.manifest.json", "opensearch/graylog_0.json.manifest.json"},
+		// Outside of the output directory only the name is left
+		{"opensearch", "/backup", "/tmp/graylog_0.json", "opensearch/graylog_0.json"},
+	}
+	for _, tt := range tests {
+		if got := s3_key(tt.prefix, tt.root, tt.name); got != tt.key {
+			t.Errorf("s3_key(%q, %q, %q) = %q, want %q", tt.prefix, tt.root, tt.name, got, tt.key)
+		}
+	}
+}
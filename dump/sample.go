@@ -0,0 +1,14 @@
+package dump
+
+// Tells whether the next document belongs to the sample
+func sample(config *Config, ctx *Context) bool {
+	switch {
+	case config.SampleEvery > 1:
+		keep := ctx.Sampled%config.SampleEvery == 0
+		ctx.Sampled++
+		return keep
+	case config.SampleRate > 0:
+		return ctx.Random.Float64() < config.SampleRate
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// How long the cluster keeps the scroll context alive between windows
+const scroll_keepalive = "1m"
+
+// Queries the opensearch for one window of data using the scroll API
+func query_scroll_database(config *Config, ctx *Context) ([]byte, error) {
+	// The first window opens the scroll with the normal query
+	if ctx.ScrollId == "" {
+		uri := with_shards(fmt.Sprintf("%s/%s/_search?scroll=%s", config.Base, escape_index(config.Index), scroll_keepalive), config)
+		buf := new(bytes.Buffer)
+		err := ctx.Template.Execute(buf, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return http_request("POST", uri, buf.Bytes(), config, ctx)
+	}
+	uri := fmt.Sprintf("%s/_search/scroll", config.Base)
+	body, err := json.Marshal(map[string]string{"scroll": scroll_keepalive, "scroll_id": ctx.ScrollId})
+	if err != nil {
+		return nil, err
+	}
+	return http_request("POST", uri, body, config, ctx)
+}
+
+// Releases the scroll context, it would expire eventually anyway
+func clear_scroll(config *Config, ctx *Context) {
+	if ctx.ScrollId == "" {
+		return
+	}
+	uri := fmt.Sprintf("%s/_search/scroll", config.Base)
+	body, err := json.Marshal(map[string][]string{"scroll_id": {ctx.ScrollId}})
+	if err == nil {
+		_, err = http_request("DELETE", uri, body, config, ctx)
+	}
+	if err != nil {
+		config.warnf("Clearing scroll failed: %s", err)
+		return
+	}
+	config.debugf("Cleared scroll")
+}
@@ -0,0 +1,566 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Query template for search_after
+const query_template string = `{
+	"size": {{.Size}},{{if versioned}}
+	"version": true,
+	"seq_no_primary_term": true,{{end}}{{if shard_stats}}
+	"explain": true,
+	"profile": true,{{end}}
+	"query": {{.Query}},{{if .PitId}}
+	"pit": {"id": {{json .PitId}}, "keep_alive": "1m"},{{end}}{{if .Cursor}}
+	"search_after": [{{.SearchAfter}}],{{end}}
+	"sort": {{.Sort}}
+}`
+
+// Builds the sort clause, custom sort field gets _id or the given tiebreakers
+func build_sort(config *Config) string {
+	// Given verbatim, search_after still takes the sort values of the last hit
+	if config.SortJson != "" {
+		return config.SortJson
+	}
+	// Index order is the fastest scan, the point in time breaks the ties by shard
+	if config.SortField == "_doc" {
+		return `["_doc"]`
+	}
+	fields := []string{}
+	if config.SortField != "" && config.SortField != "_id" {
+		fields = append(fields, config.SortField)
+	}
+	// search_after takes back the values of every field, so any number of them pages without gaps
+	if len(config.SortTiebreakers) > 0 {
+		fields = append(fields, config.SortTiebreakers...)
+	} else {
+		fields = append(fields, "_id")
+	}
+	clauses := make([]string, len(fields))
+	for i, f := range fields {
+		name, _ := json.Marshal(f)
+		clauses[i] = fmt.Sprintf(`{ %s: "%s" }`, name, config.SortOrder)
+		// Every document has an _id, so only the custom fields can be missing
+		// Their sort value may then be null, which search_after takes back as it is
+		if config.SortMissing != "" && f != "_id" {
+			clauses[i] = fmt.Sprintf(`{ %s: { "order": "%s", "missing": "%s" } }`, name, config.SortOrder, config.SortMissing)
+		}
+	}
+	return "[\n\t  " + strings.Join(clauses, ",\n\t  ") + "\n\t]"
+}
+
+// Builds the query clause, filters are combined in bool.must
+func build_query(config *Config, filters ...string) string {
+	must := filters
+	if config.Q != "" {
+		q, _ := json.Marshal(config.Q)
+		must = append(must, fmt.Sprintf(`{"query_string": {"query": %s}}`, q))
+	}
+	if len(must) == 0 {
+		must = append(must, `{"match_all": {}}`)
+	}
+	return `{"bool": {"must": [` + strings.Join(must, ", ") + `]}}`
+}
+
+// Renders a value as JSON inside templates
+func to_json(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Builds opensearch query template
+func build_query_template(config *Config) (*template.Template, error) {
+	versioned := func() bool { return config.WithVersion }
+	// Explaining tells the shard and node of every hit, the profile how long the shards searched
+	profiled := func() bool { return config.ShardStats }
+	tmpl, err := template.New("query").Funcs(template.FuncMap{"json": to_json, "versioned": versioned, "shard_stats": profiled}).Parse(query_template)
+	if err != nil {
+		return nil, err
+	}
+	config.debugf("Query template: %+v", tmpl)
+	return tmpl, nil
+}
+
+// Queries the opensearch for total amount of data
+func query_count_database(config *Config, ctx *Context) (int, error) {
+	// Request
+	// Counted from the same shards as dumped
+	uri := with_shards(fmt.Sprintf("%s/%s/_count", config.Base, escape_index(config.Index)), config)
+	body, err := http_request(config.Method, uri, []byte(`{"query": `+ctx.Query+`}`), config, ctx)
+	if err == nil {
+		// Handle results
+		json, perr := ctx.Parser.ParseBytes(body)
+		switch {
+		case perr != nil:
+			err = perr
+		case json.Exists("error"):
+			err = fmt.Errorf("_count returned an error: %s", error_reason(json))
+		case !json.Exists("count"):
+			err = fmt.Errorf("_count response has no count: %s", truncate(body, error_body_limit))
+		default:
+			count := json.GetInt("count")
+			config.debugf("Returning count %d", count)
+			return count, nil
+		}
+	}
+	// Searching would fail the same way
+	if err := check_index_not_found(err, config); errors.Is(err, ErrIndexNotFound) {
+		return 0, err
+	}
+	// Data streams and some security setups do not support _count, but searching still works
+	config.warnf("Counting with _count failed, falling back to _search: %s", err)
+	return query_total_hits(config, ctx)
+}
+
+// Queries the total amount of data from hits.total of an empty search
+func query_total_hits(config *Config, ctx *Context) (int, error) {
+	uri := with_shards(fmt.Sprintf("%s/%s/_search", config.Base, escape_index(config.Index)), config)
+	body, err := http_request(config.Method, uri, []byte(`{"size": 0, "track_total_hits": true, "query": `+ctx.Query+`}`), config, ctx)
+	if err != nil {
+		return 0, check_index_not_found(err, config)
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return 0, err
+	}
+	if json.Exists("error") {
+		return 0, fmt.Errorf("_search returned an error: %s", error_reason(json))
+	}
+	total := json.Get("hits", "total")
+	if total == nil {
+		return 0, fmt.Errorf("_search response has no hits.total: %s", truncate(body, error_body_limit))
+	}
+	// Older versions return a plain number instead of an object
+	count := total.GetInt()
+	if total.Type() == fastjson.TypeObject {
+		count = total.GetInt("value")
+	}
+	config.debugf("Returning count %d from hits.total", count)
+	return count, nil
+}
+
+// Describes the error object of an opensearch response
+func error_reason(json *fastjson.Value) string {
+	e := json.Get("error")
+	// Some errors are plain strings
+	if e.Type() == fastjson.TypeString {
+		return string(e.GetStringBytes())
+	}
+	reason := fmt.Sprintf("%s: %s", e.GetStringBytes("type"), e.GetStringBytes("reason"))
+	if json.Exists("status") {
+		reason = fmt.Sprintf("%s (status %d)", reason, json.GetInt("status"))
+	}
+	return reason
+}
+
+// Queries the indices matching pattern, and their document counts
+func list_indices(pattern string, config *Config, ctx *Context) ([]IndexInfo, error) {
+	uri := fmt.Sprintf("%s/_cat/indices", config.Base)
+	if pattern != "" {
+		uri = fmt.Sprintf("%s/%s", uri, escape_index(pattern))
+	}
+	uri = uri + "?format=json&h=index,docs.count&s=index"
+	body, err := http_get(uri, nil, config, ctx)
+	if err != nil {
+		return nil, err
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	var indices []IndexInfo
+	for _, v := range json.GetArray() {
+		info := IndexInfo{Name: string(v.GetStringBytes("index")), Docs: -1}
+		// Closed indices do not report a count
+		if count, err := strconv.ParseInt(string(v.GetStringBytes("docs.count")), 10, 64); err == nil {
+			info.Docs = count
+		}
+		indices = append(indices, info)
+	}
+	return indices, nil
+}
+
+// Appends the routing and preference parameters to the query string of the URL
+// Routing picks the shards holding its documents, the shards given are restricted next, and the preference then picks among their copies
+func with_shards(uri string, config *Config) string {
+	params := []string{}
+	if config.Routing != "" {
+		params = append(params, "routing="+url.QueryEscape(config.Routing))
+	}
+	p := config.Preference
+	if len(config.Shards) > 0 {
+		shards := make([]string, len(config.Shards))
+		for i, shard := range config.Shards {
+			shards[i] = strconv.Itoa(shard)
+		}
+		p = strings.TrimSuffix("_shards:"+strings.Join(shards, ",")+"|"+p, "|")
+	}
+	if p != "" {
+		params = append(params, "preference="+url.QueryEscape(p))
+	}
+	if len(params) == 0 {
+		return uri
+	}
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	return uri + sep + strings.Join(params, "&")
+}
+
+// Builds the search request for the next window
+func search_request(config *Config, ctx *Context) (string, []byte, error) {
+	// A full scan reads every window once, so caching them only pushes more useful entries out of the cache
+	uri := with_shards(fmt.Sprintf("%s/%s/_search?request_cache=%t", config.Base, escape_index(config.Index), config.RequestCache), config)
+	// Point in time already knows the indices, and the shard copies given when opening it
+	if ctx.PitId != "" {
+		uri = fmt.Sprintf("%s/_search", config.Base)
+	}
+	buf := new(bytes.Buffer)
+	err := ctx.Template.Execute(buf, ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return uri, buf.Bytes(), nil
+}
+
+// Checks that the search request renders into valid JSON before sending anything
+func check_search_request(config *Config, ctx *Context) error {
+	_, body, err := search_request(config, ctx)
+	if err != nil {
+		return err
+	}
+	if err := fastjson.ValidateBytes(body); err != nil {
+		return fmt.Errorf("invalid search request: %w: %s", err, truncate(body, error_body_limit))
+	}
+	return nil
+}
+
+// Queries the opensearch for one window of data
+func query_search_database(config *Config, ctx *Context) ([]byte, error) {
+	uri, body, err := search_request(config, ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Some proxies drop the bodies of GET requests
+	return http_request(config.Method, uri, body, config, ctx)
+}
+
+// Parse search results for single window, done tells that there were no more hits
+// The parser is not safe for concurrent use, so every producer passes its own
+func parse_search_results(input []byte, parser *fastjson.Parser, config *Config, ctx *Context) (result [][]byte, done bool, err error) {
+	// Parse JSON
+	parsed, err := parser.ParseBytes(input)
+	if err != nil {
+		return nil, false, malformed_error{err}
+	}
+	// Sanity check
+	if !parsed.Exists("hits") {
+		return nil, false, malformed_error{fmt.Errorf("JSON result looks incorrect: %s", truncate(input, error_body_limit))}
+	}
+	// Failed shards still return 200, with whatever the other shards found
+	if err := check_shards(parsed.Get("_shards"), config); err != nil {
+		return nil, false, err
+	}
+	// Scroll and point in time ids may change between responses, the latest one is always used
+	if id := parsed.GetStringBytes("_scroll_id"); id != nil {
+		ctx.ScrollId = string(id)
+	}
+	if id := parsed.GetStringBytes("pit_id"); id != nil {
+		ctx.PitId = string(id)
+	}
+	results := parsed.Get("hits").Get("hits").GetArray()
+	// If the array is empty, we probably just parsed everything already
+	if len(results) == 0 {
+		config.debugf("Did not get any results, bailing out")
+		return [][]byte{}, true, nil
+	}
+
+	set_cursor(results[len(results)-1], ctx)
+	if ctx.shard_stats != nil {
+		ctx.shard_stats.add_profile(parsed.Get("profile"))
+	}
+
+	// Iterate over results
+	for _, v := range results {
+		if ctx.shard_stats != nil {
+			ctx.shard_stats.add_hit(v)
+		}
+		doc, stop, err := process_hit(v, config, ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		if stop {
+			return result, true, nil
+		}
+		if doc != nil {
+			result = append(result, doc)
+		}
+	}
+	return result, false, nil
+}
+
+// Updates the search_after from the hit
+// The values are kept as raw JSON so that dates, numbers and strings keep their types
+func set_cursor(hit *fastjson.Value, ctx *Context) {
+	if sort := hit.GetArray("sort"); len(sort) > 0 {
+		cursor := make([]json.RawMessage, len(sort))
+		for i, s := range sort {
+			cursor[i] = s.MarshalTo([]byte{})
+		}
+		ctx.Cursor = cursor
+	}
+}
+
+// Turns a hit into an output document, nil if the hit is dropped, stop tells that no more are wanted
+func process_hit(v *fastjson.Value, config *Config, ctx *Context) (doc []byte, stop bool, err error) {
+	// Documents can move in a live index, and be returned twice without a point in time
+	if ctx.Seen != nil {
+		key := string(v.GetStringBytes("_index")) + "/" + string(v.GetStringBytes("_id"))
+		if _, ok := ctx.Seen[key]; ok {
+			ctx.Duplicates++
+			return nil, false, ctx.rejects.add(v, "duplicate", config)
+		}
+		ctx.Seen[key] = struct{}{}
+	}
+	// search_after cannot jump ahead, so skipped documents are fetched and dropped
+	if ctx.Skipped < config.Skip {
+		ctx.Skipped++
+		return nil, false, ctx.rejects.add(v, "skipped", config)
+	}
+	// Pagination goes through every document, only the output is thinned
+	if !sample(config, ctx) {
+		return nil, false, ctx.rejects.add(v, "sampled out", config)
+	}
+	// The rest of the window is dropped, so that the limit is not overshot
+	if config.MaxDocs > 0 && int(ctx.Counter.Load()) >= config.MaxDocs {
+		config.debugf("Reached the maximum of %d documents", config.MaxDocs)
+		return nil, true, nil
+	}
+	// Remove sort information
+	if v.Exists("sort") {
+		v.Del("sort")
+	}
+	redact(v, config)
+	transform(v, config, ctx)
+	if config.Flatten {
+		flatten(v, config, ctx)
+	}
+	// Numbers are kept as their original text, so marshaling never rounds large integers or precise decimals
+	// Growing the buffer for huge documents would leave garbage behind for every one of them
+	ctx.scratch = v.MarshalTo(ctx.scratch[:0])
+	if config.MaxDocSize > 0 && int64(len(ctx.scratch)) > config.MaxDocSize {
+		ctx.Oversized++
+		config.warnf("Skipped document %s/%s of %d bytes, larger than the maximum of %d", v.GetStringBytes("_index"), v.GetStringBytes("_id"), len(ctx.scratch), config.MaxDocSize)
+		return nil, false, ctx.rejects.add(v, "oversized", config)
+	}
+	if config.Incremental != "" {
+		observe_watermark(v, config, ctx)
+	}
+	if config.TrackRange != "" {
+		observe_range(v, config, ctx)
+	}
+	// Increase query counter
+	ctx.Counter.Add(1)
+	doc = copy_to_arena(ctx.scratch, ctx)
+	if config.Pretty {
+		buf := new(bytes.Buffer)
+		if err := json.Indent(buf, doc, "", "  "); err != nil {
+			return nil, false, err
+		}
+		doc = buf.Bytes()
+	}
+	return doc, false, nil
+}
+
+// Size of the blocks documents are copied into
+const arena_size = 1 << 20
+
+// Copies the document into the current block, starting a new one when it is full
+// A block is freed once every document in it has been written, a document kept for long keeps its whole block
+func copy_to_arena(doc []byte, ctx *Context) []byte {
+	if cap(ctx.arena)-len(ctx.arena) < len(doc) {
+		ctx.arena = make([]byte, 0, max(arena_size, len(doc)))
+	}
+	start := len(ctx.arena)
+	ctx.arena = append(ctx.arena, doc...)
+	// Capped, so that appending to the document cannot overwrite the next one
+	return ctx.arena[start:len(ctx.arena):len(ctx.arena)]
+}
+
+// Waits until n more documents are allowed by the rate limit
+func throttle(ctx *Context, n int) error {
+	if ctx.Limiter == nil {
+		return nil
+	}
+	err := ctx.Limiter.WaitN(ctx.Ctx, n)
+	// The limiter gives up early when waiting would pass the deadline, the dump stops there anyway
+	if _, ok := ctx.Ctx.Deadline(); ok && err != nil && ctx.Ctx.Err() == nil {
+		<-ctx.Ctx.Done()
+		return ctx.Ctx.Err()
+	}
+	return err
+}
+
+// Sends a batch of documents to the consumers
+func send(batch [][]byte, config *Config, ctx *Context) error {
+	select {
+	case *ctx.Tasks <- task{docs: batch, window: ctx.completed.Load()}:
+		ctx.sent += int64(len(batch))
+		ctx.prefetched(config, len(batch))
+		return nil
+	case <-ctx.Ctx.Done():
+		return ctx.Ctx.Err()
+	}
+}
+
+// Pauses fetching while the consumers are behind, so that documents do not pile up in memory
+// Fetching stops when the channel is half full, and continues once it is down to a quarter
+func wait_for_consumers(config *Config, ctx *Context) error {
+	if err := wait_for_windows(config, ctx); err != nil {
+		return err
+	}
+	// Nothing is written before the prefetch, so waiting would never end
+	select {
+	case <-ctx.writing:
+	default:
+		return nil
+	}
+	capacity := cap(*ctx.Tasks)
+	if len(*ctx.Tasks) <= capacity/2 {
+		return nil
+	}
+	config.debugf("Writing is behind by %d batches, pausing fetching", len(*ctx.Tasks))
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for len(*ctx.Tasks) > capacity/4 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Ctx.Done():
+			return ctx.Ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Pauses fetching while the maximum of windows is waiting to be written
+// Windows of large documents weigh more than a channel full of small ones
+func wait_for_windows(config *Config, ctx *Context) error {
+	if config.MaxInflightWindows == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// The documents are taken in the order they were sent, so the oldest window is always written first
+		for len(ctx.inflight) > 0 && ctx.taken.Load() >= ctx.inflight[0] {
+			ctx.inflight = ctx.inflight[1:]
+		}
+		if len(ctx.inflight) < config.MaxInflightWindows {
+			return nil
+		}
+		// Nothing is written before the prefetch, which could then never be reached
+		ctx.start_writing(config)
+		select {
+		case <-ticker.C:
+		case <-ctx.Ctx.Done():
+			return ctx.Ctx.Err()
+		}
+	}
+}
+
+// Lets the dump go on after a response that could not be parsed, when tolerant and not too many in a row
+// search_after asks for the same window again, while a scroll has already moved past it and loses the window
+func tolerate(err error, body []byte, config *Config, ctx *Context) error {
+	if !config.Tolerant || !errors.Is(err, ErrMalformedResponse) || ctx.malformed_run >= config.Retries {
+		return err
+	}
+	ctx.malformed_run++
+	ctx.Malformed++
+	if err := ctx.rejects.add_response(body, err, config); err != nil {
+		return err
+	}
+	wait := min(retry_wait<<(ctx.malformed_run-1), max_retry_wait)
+	if config.Mode == "scroll" {
+		config.warnf("Skipping a window in %s, its documents are missing from the dump: %s", wait, err)
+	} else {
+		config.warnf("Fetching the window again in %s, attempt %d of %d: %s", wait, ctx.malformed_run, config.Retries, err)
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Ctx.Done():
+		return ctx.Ctx.Err()
+	}
+}
+
+// Loops the search and sends the results to a channel
+func producer(ctx *Context, config *Config) error {
+	if config.Stream {
+		return stream_producer(ctx, config)
+	}
+	if config.Aggregate != "" {
+		return aggregate_producer(ctx, config)
+	}
+	query := query_search_database
+	if config.Mode == "scroll" {
+		query = query_scroll_database
+		defer clear_scroll(config, ctx)
+	}
+	parser := &fastjson.Parser{}
+	for {
+		if err := wait_for_consumers(config, ctx); err != nil {
+			return err
+		}
+		started := time.Now()
+		q, err := query(config, ctx)
+		if err != nil {
+			return err
+		}
+		latency := time.Since(started)
+		record_latency(config, ctx, latency)
+		adapt_size(config, ctx, latency)
+		r, done, err := parse_search_results(q, parser, config, ctx)
+		if err != nil {
+			if err := tolerate(err, q, config, ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		ctx.malformed_run = 0
+		config.Metrics.add_window()
+		ctx.http_dump.close(config)
+		// Throttle a whole window at once, the burst is sized to fit one
+		if len(r) > 0 {
+			if err := throttle(ctx, len(r)); err != nil {
+				return err
+			}
+		}
+		for x := 0; x < len(r); x += config.Batch {
+			if err := send(r[x:min(x+config.Batch, len(r))], config, ctx); err != nil {
+				return err
+			}
+		}
+		ctx.window_sent(config)
+		if done && next_ids_chunk(config, ctx) {
+			continue
+		}
+		if done {
+			config.debugf("Nothing more to produce, breaking the loop")
+			break
+		}
+	}
+	config.debugf("Producer done")
+	return nil
+}
@@ -0,0 +1,247 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+// Renders the search request that follows a response with the given hits, the first window without any
+func render_after(t *testing.T, config *Config, hits string) *fastjson.Value {
+	t.Helper()
+	tmpl, err := build_query_template(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &Context{Size: 100, Parser: &fastjson.Parser{}, Template: tmpl, Query: build_query(config), Sort: build_sort(config)}
+	if hits != "" {
+		if _, _, err := parse_search_results([]byte(`{"hits":{"hits":[`+hits+`]}}`), &fastjson.Parser{}, config, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := ctx.Template.Execute(buf, ctx); err != nil {
+		t.Fatal(err)
+	}
+	request, err := fastjson.ParseBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("invalid search request: %s\n%s", err, buf)
+	}
+	return request
+}
+
+func TestSearchAfterKeepsTypes(t *testing.T) {
+	tests := []struct {
+		name  string
+		sort  string
+		hit   string
+		after string
+	}{
+		{"date and keyword", "@timestamp", `{"_id":"doc00001","sort":[1705276860000,"doc00001"]}`, `[1705276860000,"doc00001"]`},
+		{"date before the epoch", "@timestamp", `{"_id":"a","sort":[-86400000,"a"]}`, `[-86400000,"a"]`},
+		{"long past float precision", "n", `{"_id":"b","sort":[9007199254740993,"b"]}`, `[9007199254740993,"b"]`},
+		{"unsigned long past int64", "n", `{"_id":"c","sort":[18446744073709551615,"c"]}`, `[18446744073709551615,"c"]`},
+		{"double", "n", `{"_id":"d","sort":[1.50e-7,"d"]}`, `[1.50e-7,"d"]`},
+		{"keyword needing escapes", "user.name", `{"_id":"e","sort":["u\"0\\ä","e"]}`, `["u\"0\\ä","e"]`},
+		{"missing value", "n", `{"_id":"f","sort":[null,"f"]}`, `[null,"f"]`},
+		{"_id only", "", `{"_id":"g","sort":["g"]}`, `["g"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{SortField: tt.sort, SortOrder: "asc"}
+			request := render_after(t, config, `{"_id":"first","sort":[0,"first"]},`+tt.hit)
+			after := request.Get("search_after")
+			if after == nil {
+				t.Fatal("no search_after in the request")
+			}
+			if got := string(after.MarshalTo(nil)); got != tt.after {
+				t.Errorf("search_after %s, want %s", got, tt.after)
+			}
+			if got, want := len(request.GetArray("sort")), len(after.GetArray()); got != want {
+				t.Errorf("%d sort fields for %d search_after values", got, want)
+			}
+		})
+	}
+}
+
+func TestSearchAfterTiebreakers(t *testing.T) {
+	config := &Config{SortField: "@timestamp", SortOrder: "desc", SortTiebreakers: []string{"n", "user.name"}}
+	request := render_after(t, config, `{"_id":"x","sort":[1705276860000,12345678901234567890,"u1"]}`)
+	if got, want := string(request.Get("search_after").MarshalTo(nil)), `[1705276860000,12345678901234567890,"u1"]`; got != want {
+		t.Errorf("search_after %s, want %s", got, want)
+	}
+	if got, want := string(request.Get("sort").MarshalTo(nil)), `[{"@timestamp":"desc"},{"n":"desc"},{"user.name":"desc"}]`; got != want {
+		t.Errorf("sort %s, want %s", got, want)
+	}
+}
+
+func TestFirstWindowHasNoSearchAfter(t *testing.T) {
+	request := render_after(t, &Config{SortField: "@timestamp", SortOrder: "asc"}, "")
+	if request.Exists("search_after") {
+		t.Errorf("search_after in the first window: %s", request.Get("search_after"))
+	}
+	// A hit without sort values keeps the cursor where it was
+	request = render_after(t, &Config{SortOrder: "asc"}, `{"_id":"a"}`)
+	if request.Exists("search_after") {
+		t.Errorf("search_after without sort values: %s", request.Get("search_after"))
+	}
+}
+
+// Numbers past float64 range and precision, exponents and negative zero
+const numbers_source = `{"big":123456789012345678901234567890,"f":0.1000000000000000055511151231257827,"e":1E400,"neg":-0.0,"exp":1.50e-7,"arr":[9007199254740993,2.5E+10],"o":{"x":18446744073709551617}}`
+
+func TestProcessHitKeepsNumbers(t *testing.T) {
+	hit := `{"_id":"a","_source":` + numbers_source + `,"sort":[123456789012345678901234567890,"a"]}`
+	tests := []struct {
+		name   string
+		config Config
+		doc    string
+	}{
+		{"plain", Config{}, `{"_id":"a","_source":` + numbers_source + `}`},
+		{"flatten", Config{Flatten: true, FlattenArrays: "join"},
+			`{"_id":"a","_source":{"big":123456789012345678901234567890,"f":0.1000000000000000055511151231257827,"e":1E400,"neg":-0.0,"exp":1.50e-7,"arr":"9007199254740993,2.5E+10","o.x":18446744073709551617}}`},
+		{"pretty", Config{Pretty: true}, `{
+  "_id": "a",
+  "_source": {
+    "big": 123456789012345678901234567890,
+    "f": 0.1000000000000000055511151231257827,
+    "e": 1E400,
+    "neg": -0.0,
+    "exp": 1.50e-7,
+    "arr": [
+      9007199254740993,
+      2.5E+10
+    ],
+    "o": {
+      "x": 18446744073709551617
+    }
+  }
+}`},
+		{"flatten and pretty", Config{Flatten: true, FlattenArrays: "join", Pretty: true}, `{
+  "_id": "a",
+  "_source": {
+    "big": 123456789012345678901234567890,
+    "f": 0.1000000000000000055511151231257827,
+    "e": 1E400,
+    "neg": -0.0,
+    "exp": 1.50e-7,
+    "arr": "9007199254740993,2.5E+10",
+    "o.x": 18446744073709551617
+  }
+}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := fastjson.Parse(hit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, _, err := process_hit(v, &tt.config, &Context{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(doc) != tt.doc {
+				t.Errorf("got\n%s\nwant\n%s", doc, tt.doc)
+			}
+		})
+	}
+}
+
+func TestProcessHitRawLineFeed(t *testing.T) {
+	// Invalid JSON, but parsed all the same, and an escaped line feed that is fine
+	hit := "{\"_id\":\"a\",\"_source\":{\"raw\":\"x\ny\",\"escaped\":\"p\\nq\"}}"
+	tests := []struct {
+		name   string
+		strict bool
+		err    string
+	}{
+		{"not strict", false, ""},
+		{"strict", true, "raw line feed at byte 30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := fastjson.Parse(hit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &Config{StrictNdjson: tt.strict}
+			doc, _, err := process_hit(v, config, &Context{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Marshaling does not escape the line feed, only the check before writing catches it
+			if got, want := string(doc), "{\"_id\":\"a\",\"_source\":{\"raw\":\"x\ny\",\"escaped\":\"p\\nq\"}}"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			err = check_ndjson(doc, config)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// A typical log line of about 430 bytes, as returned by search_after
+const bench_hit = `{"_index":"graylog_0","_id":"0c0e7a52-6c9b-11ee-b962-0242ac120002","_score":null,` +
+	`"_source":{"@timestamp":"2024-01-15T00:01:00.000Z","source":"web-01","level":6,"facility":"nginx",` +
+	`"message":"10.0.0.1 - - [15/Jan/2024:00:01:00 +0000] \"GET /api/v1/items?page=2 HTTP/1.1\" 200 5123",` +
+	`"http":{"status":200,"bytes":5123,"took_ms":12.5},"user":{"name":"u1","email":"x@y.z"}},` +
+	`"sort":[1705276860000,"0c0e7a52-6c9b-11ee-b962-0242ac120002"]}`
+
+// Compares parsing alone to parsing and turning the hit into a document, the difference is the marshaling
+func BenchmarkProcessHit(b *testing.B) {
+	var parser fastjson.Parser
+	b.Run("parse", func(b *testing.B) {
+		b.SetBytes(int64(len(bench_hit)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := parser.Parse(bench_hit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parse and process", func(b *testing.B) {
+		config, ctx := &Config{}, &Context{}
+		b.SetBytes(int64(len(bench_hit)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v, err := parser.Parse(bench_hit)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := process_hit(v, config, ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// A full search window of 1000 hits
+func BenchmarkParseSearchResults(b *testing.B) {
+	hits := make([]string, 1000)
+	for i := range hits {
+		hits[i] = bench_hit
+	}
+	body := []byte(fmt.Sprintf(`{"took":5,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},`+
+		`"hits":{"total":{"value":1000,"relation":"eq"},"max_score":null,"hits":[%s]}}`, strings.Join(hits, ",")))
+	var parser fastjson.Parser
+	config, ctx := &Config{}, &Context{}
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		docs, _, err := parse_search_results(body, &parser, config, ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(docs) != len(hits) {
+			b.Fatalf("%d documents from %d hits", len(docs), len(hits))
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package dump
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// Checks the _shards of a search response, partial results are handled as configured
+func check_shards(shards *fastjson.Value, config *Config) error {
+	if shards == nil || shards.GetInt("failed") == 0 {
+		return nil
+	}
+	var details []string
+	for _, f := range shards.GetArray("failures") {
+		details = append(details, fmt.Sprintf("%s[%d] on %s: %s: %s",
+			f.GetStringBytes("index"), f.GetInt("shard"), f.GetStringBytes("node"),
+			f.GetStringBytes("reason", "type"), f.GetStringBytes("reason", "reason")))
+	}
+	msg := fmt.Sprintf("%d of %d shards failed, results are partial", shards.GetInt("failed"), shards.GetInt("total"))
+	if len(details) > 0 {
+		msg = msg + ": " + strings.Join(details, "; ")
+	}
+	switch config.OnShardFailure {
+	case "warn":
+		config.warnf("%s", msg)
+	case "continue":
+		config.debugf("%s", msg)
+	default:
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package dump
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Documents and search time of a shard, collected with ShardStats
+type ShardStat struct {
+	Index string
+	Shard int
+	// Node of the searched copy, by name if it could be looked up, the last one if the copies varied
+	Node string
+	// Hits the shard returned
+	Docs int
+	// Time the shard spent searching, as profiled
+	Took time.Duration
+}
+
+// Returns the documents per second the shard searched, 0 without profiled time
+func (s ShardStat) Rate() float64 {
+	if s.Took <= 0 {
+		return 0
+	}
+	return float64(s.Docs) / s.Took.Seconds()
+}
+
+type shard_key struct {
+	index string
+	shard int
+}
+
+// Statistics of the shards seen in the responses, updated only by the producer
+type shard_stats map[shard_key]*ShardStat
+
+// Returns the statistics of the shard, adding it when first seen
+func (s shard_stats) get(index string, shard int) *ShardStat {
+	k := shard_key{index, shard}
+	if s[k] == nil {
+		s[k] = &ShardStat{Index: index, Shard: shard}
+	}
+	return s[k]
+}
+
+// Splits the bracketed parts of a shard description, such as [index][0] or [node][index][0]
+func bracketed(s string) []string {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil
+	}
+	return strings.Split(s[1:len(s)-1], "][")
+}
+
+// Counts the hit to the shard it came from, and removes what explaining added to it
+func (s shard_stats) add_hit(hit *fastjson.Value) {
+	parts := bracketed(string(hit.GetStringBytes("_shard")))
+	hit.Del("_shard")
+	hit.Del("_explanation")
+	node := string(hit.GetStringBytes("_node"))
+	hit.Del("_node")
+	if len(parts) != 2 {
+		return
+	}
+	shard, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	stat := s.get(parts[0], shard)
+	stat.Docs++
+	stat.Node = node
+}
+
+// Adds the searching times of the shards from the profile of the response
+// The top level queries and collectors already include the time of their children
+func (s shard_stats) add_profile(profile *fastjson.Value) {
+	for _, p := range profile.GetArray("shards") {
+		parts := bracketed(string(p.GetStringBytes("id")))
+		if len(parts) != 3 {
+			continue
+		}
+		shard, err := strconv.Atoi(parts[2])
+		if err != nil {
+			continue
+		}
+		var took int64
+		for _, search := range p.GetArray("searches") {
+			took += search.GetInt64("rewrite_time")
+			for _, q := range search.GetArray("query") {
+				took += q.GetInt64("time_in_nanos")
+			}
+			for _, c := range search.GetArray("collector") {
+				took += c.GetInt64("time_in_nanos")
+			}
+		}
+		for _, f := range p.GetArray("fetch") {
+			took += f.GetInt64("time_in_nanos")
+		}
+		stat := s.get(parts[1], shard)
+		stat.Took += time.Duration(took)
+		stat.Node = parts[0]
+	}
+}
+
+// Returns the statistics slowest first, with the node ids replaced by their names
+func (s shard_stats) list(config *Config, ctx *Context) []ShardStat {
+	if len(s) == 0 {
+		return nil
+	}
+	names := node_names(config, ctx)
+	list := make([]ShardStat, 0, len(s))
+	for _, stat := range s {
+		if name, ok := names[stat.Node]; ok {
+			stat.Node = name
+		}
+		list = append(list, *stat)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Rate() != list[j].Rate() {
+			return list[i].Rate() < list[j].Rate()
+		}
+		if list[i].Index != list[j].Index {
+			return list[i].Index < list[j].Index
+		}
+		return list[i].Shard < list[j].Shard
+	})
+	return list
+}
+
+// Looks up the names of the nodes by their ids, the ids are reported as they are if it fails
+func node_names(config *Config, ctx *Context) map[string]string {
+	body, err := http_request("GET", fmt.Sprintf("%s/_nodes?filter_path=nodes.*.name", config.Base), nil, config, ctx)
+	if err != nil {
+		config.warnf("Could not look up the names of the nodes: %s", err)
+		return nil
+	}
+	parsed, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		config.warnf("Could not look up the names of the nodes: %s", err)
+		return nil
+	}
+	names := map[string]string{}
+	parsed.GetObject("nodes").Visit(func(id []byte, v *fastjson.Value) {
+		names[string(id)] = string(v.GetStringBytes("name"))
+	})
+	return names
+}
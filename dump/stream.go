@@ -0,0 +1,189 @@
+package dump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Stops walking the response once no more documents are wanted
+var errStopStream = errors.New("stop streaming")
+
+// Reads the next token, expecting the delimiter
+func expect_delim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %s in the response, got %v", delim, t)
+	}
+	return nil
+}
+
+// Walks the members of a JSON object, the callback has to consume each value
+func stream_object(dec *json.Decoder, member func(key string) error) error {
+	if err := expect_delim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := t.(string)
+		if err := member(key); err != nil {
+			return err
+		}
+	}
+	return expect_delim(dec, '}')
+}
+
+// Consumes a value that is not needed
+func skip_value(dec *json.Decoder) error {
+	var raw json.RawMessage
+	return dec.Decode(&raw)
+}
+
+// Queries one window, and sends the documents to the channel while the response is still being read
+//
+// Only a single hit is held in memory at a time, instead of the whole response and its parsed tree.
+func stream_window(parser *fastjson.Parser, config *Config, ctx *Context) (done bool, err error) {
+	uri, body, err := search_request(config, ctx)
+	if err != nil {
+		return false, err
+	}
+	started := time.Now()
+	rc, err := http_stream(config.Method, uri, body, config, ctx)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	// Only the time to the response is known before the documents are consumed
+	latency := time.Since(started)
+	record_latency(config, ctx, latency)
+	adapt_size(config, ctx, latency)
+
+	found := false
+	hits := 0
+	batch := make([][]byte, 0, config.Batch)
+	dec := json.NewDecoder(rc)
+	hit := func() error {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		v, err := parser.ParseBytes(raw)
+		if err != nil {
+			return err
+		}
+		hits++
+		set_cursor(v, ctx)
+		doc, stop, err := process_hit(v, config, ctx)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return errStopStream
+		}
+		if doc == nil {
+			return nil
+		}
+		if err := throttle(ctx, 1); err != nil {
+			return err
+		}
+		batch = append(batch, doc)
+		if len(batch) < config.Batch {
+			return nil
+		}
+		// The consumer owns the sent batch
+		full := batch
+		batch = make([][]byte, 0, config.Batch)
+		return send(full, config, ctx)
+	}
+	err = stream_object(dec, func(key string) error {
+		switch key {
+		// Scroll and point in time ids may change between responses, the latest one is always used
+		case "pit_id":
+			return dec.Decode(&ctx.PitId)
+		// Failed shards still return 200, with whatever the other shards found
+		case "_shards":
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			shards, err := fastjson.ParseBytes(raw)
+			if err != nil {
+				return err
+			}
+			return check_shards(shards, config)
+		case "hits":
+			found = true
+			return stream_object(dec, func(key string) error {
+				if key != "hits" {
+					return skip_value(dec)
+				}
+				if err := expect_delim(dec, '['); err != nil {
+					return err
+				}
+				for dec.More() {
+					if err := hit(); err != nil {
+						return err
+					}
+				}
+				return expect_delim(dec, ']')
+			})
+		}
+		return skip_value(dec)
+	})
+	// What is left at the end of the window, or when stopping early, is sent as it is
+	if err == nil || errors.Is(err, errStopStream) {
+		if len(batch) > 0 {
+			if serr := send(batch, config, ctx); serr != nil {
+				return false, serr
+			}
+		}
+	}
+	if errors.Is(err, errStopStream) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, errors.New("JSON result looks incorrect, there are no hits")
+	}
+	if hits == 0 {
+		config.debugf("Did not get any results, bailing out")
+	}
+	return hits == 0, nil
+}
+
+// Loops the search, streaming each window to the channel
+func stream_producer(ctx *Context, config *Config) error {
+	parser := &fastjson.Parser{}
+	for {
+		if err := wait_for_consumers(config, ctx); err != nil {
+			return err
+		}
+		done, err := stream_window(parser, config, ctx)
+		if err != nil {
+			return err
+		}
+		config.Metrics.add_window()
+		ctx.http_dump.close(config)
+		ctx.window_sent(config)
+		if done && next_ids_chunk(config, ctx) {
+			continue
+		}
+		if done {
+			config.debugf("Nothing more to produce, breaking the loop")
+			break
+		}
+	}
+	config.debugf("Producer done")
+	return nil
+}
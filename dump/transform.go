@@ -0,0 +1,65 @@
+package dump
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// A dot-path of a _source field with a value, the new name of a renamed field or the value of an added one
+type FieldPair struct {
+	Field string
+	Value string
+}
+
+// Parses the values of the added fields once, they are shared by every document like the mask
+func added_values(config *Config) []*fastjson.Value {
+	values := make([]*fastjson.Value, len(config.AddFields))
+	for i, a := range config.AddFields {
+		s, _ := json.Marshal(a.Value)
+		values[i] = fastjson.MustParseBytes(s)
+	}
+	return values
+}
+
+// Sets the field of the dot-path in _source, creating the objects leading to it
+// Nothing is set when the path runs into something else than an object
+func set_field(hit *fastjson.Value, path string, v *fastjson.Value) {
+	parent := hit.Get("_source")
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		if parent == nil || parent.Type() != fastjson.TypeObject {
+			return
+		}
+		child := parent.Get(key)
+		if child == nil {
+			child = fastjson.MustParse(`{}`)
+			parent.Set(key, child)
+		}
+		parent = child
+	}
+	if parent == nil || parent.Type() != fastjson.TypeObject {
+		return
+	}
+	parent.Set(keys[len(keys)-1], v)
+}
+
+// Renames and adds the configured fields of a hit, in the order given
+func transform(hit *fastjson.Value, config *Config, ctx *Context) {
+	for _, r := range config.RenameFields {
+		parent, key := field_parent(hit, r.Field)
+		if parent == nil {
+			continue
+		}
+		v := parent.Get(key)
+		if v == nil {
+			continue
+		}
+		parent.Del(key)
+		set_field(hit, r.Value, v)
+	}
+	for i, a := range config.AddFields {
+		set_field(hit, a.Field, ctx.added[i])
+	}
+}
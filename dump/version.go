@@ -0,0 +1,59 @@
+package dump
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Queries the distribution and version of the cluster
+func query_cluster_version(config *Config, ctx *Context) error {
+	body, err := http_get(config.Base+"/", nil, config, ctx)
+	if err != nil {
+		return err
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		return err
+	}
+	// Elasticsearch does not report distribution at all
+	ctx.Distribution = "elasticsearch"
+	if d := json.GetStringBytes("version", "distribution"); d != nil {
+		ctx.Distribution = string(d)
+	}
+	ctx.Version = string(json.GetStringBytes("version", "number"))
+	return nil
+}
+
+// Tells whether the cluster should be talked to like an Elasticsearch cluster
+func elasticsearch(config *Config, ctx *Context) bool {
+	return config.EsCompat || ctx.Distribution == "elasticsearch"
+}
+
+// Tells whether the detected version is at least major.minor, unknown versions are assumed to be recent
+func version_at_least(ctx *Context, major int, minor int) bool {
+	parts := strings.SplitN(ctx.Version, ".", 3)
+	if len(parts) < 2 {
+		return true
+	}
+	ma, err1 := strconv.Atoi(parts[0])
+	mi, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	return ma > major || (ma == major && mi >= minor)
+}
+
+// Checks that the cluster supports point in time
+func check_pit_support(config *Config, ctx *Context) error {
+	if elasticsearch(config, ctx) {
+		if !version_at_least(ctx, 7, 10) {
+			return fmt.Errorf("point in time requires Elasticsearch 7.10 or newer, cluster is %s", ctx.Version)
+		}
+		return nil
+	}
+	if !version_at_least(ctx, 2, 4) {
+		return fmt.Errorf("point in time requires OpenSearch 2.4 or newer, cluster is %s", ctx.Version)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package dump
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/valyala/fastjson"
+)
+
+// Reads the smallest index.max_result_window of the indices, 0 if it could not be read
+// Like from and size, every search_after or scroll window has to fit in it
+func query_result_window(config *Config, ctx *Context) int {
+	uri := fmt.Sprintf("%s/%s/_settings/index.max_result_window?include_defaults=true&flat_settings=true", config.Base, escape_index(config.Index))
+	body, err := http_get(uri, nil, config, ctx)
+	if err != nil {
+		config.debugf("Could not read index.max_result_window: %s", err)
+		return 0
+	}
+	json, err := ctx.Parser.ParseBytes(body)
+	if err != nil {
+		config.debugf("Could not read index.max_result_window: %s", err)
+		return 0
+	}
+	limit := 0
+	obj, err := json.Object()
+	if err != nil {
+		return 0
+	}
+	obj.Visit(func(_ []byte, index *fastjson.Value) {
+		// Explicit settings override the defaults
+		v := index.Get("settings", "index.max_result_window")
+		if v == nil {
+			v = index.Get("defaults", "index.max_result_window")
+		}
+		if v == nil {
+			return
+		}
+		n, err := strconv.Atoi(string(v.GetStringBytes()))
+		if err == nil && n > 0 && (limit == 0 || n < limit) {
+			limit = n
+		}
+	})
+	return limit
+}
+
+// Lowers the window size to index.max_result_window, instead of every search failing on it
+func check_result_window(config *Config, ctx *Context) {
+	limit := query_result_window(config, ctx)
+	if limit == 0 {
+		return
+	}
+	ctx.ResultWindow = limit
+	if ctx.Size > limit {
+		config.warnf("Window size %d is over index.max_result_window %d of %s, lowering it to %d", ctx.Size, limit, config.Index, limit)
+		ctx.Size = limit
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "github.com/mikkolehtisalo/osdump/dump"
+
+// There is no SIGUSR1 to ask for the progress with
+func notify_progress(running func() []dump.Progress) {}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mikkolehtisalo/osdump/dump"
+)
+
+// Logs the progress of the running dumps every time SIGUSR1 is received
+func notify_progress(running func() []dump.Progress) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			for _, p := range running() {
+				print_progress(p)
+			}
+		}
+	}()
+}